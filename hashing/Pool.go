@@ -0,0 +1,109 @@
+package hashing
+
+import (
+	"crypto/sha1"
+	"runtime"
+	"sync"
+)
+
+// Pool hashes buffers on a fixed number of goroutines. However many torrents share a pool, hashing never
+// keeps more CPUs busy than it has workers. Work beyond that waits in a queue.
+type Pool struct {
+	workers int
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	queue  []job
+	closed bool
+}
+
+type job struct {
+	buf  []byte
+	done func(sum [20]byte)
+}
+
+// Default is shared by every torrent that does not bring its own pool
+var Default = NewPool(runtime.NumCPU())
+
+// NewPool starts a pool with the given number of workers, at least one
+func NewPool(workers int) *Pool {
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &Pool{workers: workers}
+	p.cond = sync.NewCond(&p.lock)
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *Pool) Workers() int {
+
+	return p.workers
+}
+
+// Submit queues buf for hashing and returns right away. done is called with the SHA-1 of buf on one of the
+// pool's goroutines, and buf must not change until then.
+func (p *Pool) Submit(buf []byte, done func(sum [20]byte)) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		panic("hashing: submit to closed pool")
+	}
+
+	p.queue = append(p.queue, job{buf, done})
+	p.cond.Signal()
+}
+
+// Sum hashes buf on the pool and waits for the result
+func (p *Pool) Sum(buf []byte) [20]byte {
+
+	result := make(chan [20]byte, 1)
+
+	p.Submit(buf, func(sum [20]byte) { result <- sum })
+
+	return <-result
+}
+
+// Close stops the workers once the queued work is done
+func (p *Pool) Close() {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+func (p *Pool) work() {
+
+	for {
+
+		p.lock.Lock()
+
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+
+		if len(p.queue) == 0 {
+
+			p.lock.Unlock()
+			return
+		}
+
+		next := p.queue[0]
+		p.queue[0] = job{}
+		p.queue = p.queue[1:]
+
+		p.lock.Unlock()
+
+		next.done(sha1.Sum(next.buf))
+	}
+}
@@ -1,17 +1,118 @@
 package main
 
 import (
+	"example/bittorrent_in_go/model"
 	"example/bittorrent_in_go/service"
+	"fmt"
 	"os"
 )
 
 func main() {
 
-	service := service.NewTorrentService(os.Args[1])
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
 
-	service.CreateClients()
+		os.Exit(verify(os.Args[2:]))
+	}
 
-	service.Download()
+	if len(os.Args) > 1 && os.Args[1] == "create" {
 
-	service.CloseConnections()
+		os.Exit(create(os.Args[2:]))
+	}
+
+	os.Exit(download(os.Args[1]))
+}
+
+// download fetches the content of a torrent into the working directory, failing when it stalls or cannot be stored
+func download(path string) int {
+
+	service, err := service.NewTorrentService(path)
+
+	if err != nil {
+
+		fmt.Println(err)
+		return 1
+	}
+
+	defer service.CloseConnections()
+
+	// Without peers from the tracker now, the download keeps asking until it gives up
+	if err := service.Announce(); err != nil {
+		fmt.Println(err)
+	}
+
+	if err := service.Download(); err != nil {
+
+		fmt.Println(err)
+		return 1
+	}
+
+	return 0
+}
+
+// verify hash-checks the data of a torrent already on disk: verify <torrent> [download dir]
+func verify(args []string) int {
+
+	if len(args) < 1 {
+
+		fmt.Println("usage: verify <torrent> [download dir]")
+		return 2
+	}
+
+	service, err := service.NewTorrentService(args[0])
+
+	if err != nil {
+
+		fmt.Println(err)
+		return 2
+	}
+
+	if len(args) > 1 {
+		service.Config.DownloadDir = args[1]
+	}
+
+	result, err := service.Verify()
+
+	if err != nil {
+
+		fmt.Println(err)
+		return 2
+	}
+
+	fmt.Printf("%s: %0.2f%% of %d pieces valid\n", service.Torrent.Name, result.Percent(), result.Pieces)
+
+	if result.OK() {
+		return 0
+	}
+
+	fmt.Printf("Bad pieces: %v\n", result.BadPieces)
+
+	for _, path := range result.BadFiles {
+		fmt.Printf("Bad file: %s\n", path)
+	}
+
+	return 1
+}
+
+// create writes a torrent of a file or directory: create <path> <announce url> <torrent>
+func create(args []string) int {
+
+	if len(args) < 3 {
+
+		fmt.Println("usage: create <path> <announce url> <torrent>")
+		return 2
+	}
+
+	torrent, err := model.CreateTorrent(args[0], model.CreateOptions{Announce: args[1], Align: true})
+
+	if err == nil {
+		err = os.WriteFile(args[2], torrent, 0644)
+	}
+
+	if err != nil {
+
+		fmt.Println(err)
+		return 1
+	}
+
+	return 0
 }
@@ -1,13 +1,71 @@
 package model
 
-type Bitfield []byte
+import (
+	"fmt"
+	"math/bits"
+)
 
+// Bitfield holds one bit per piece, most significant bit first, for a fixed number of pieces.
+// Any bits past the piece count in the last byte are spare bits and always stay zero.
+type Bitfield struct {
+	bits   []byte
+	length int
+}
+
+// NewBitfield returns an empty bitfield able to hold length pieces
+func NewBitfield(length int) Bitfield {
+
+	return Bitfield{bits: make([]byte, (length+7)/8), length: length}
+}
+
+// ParseBitfield checks a received bitfield against the number of pieces in the torrent
+func ParseBitfield(payload []byte, length int) (Bitfield, error) {
+
+	if length < 0 || len(payload) != (length+7)/8 {
+		return Bitfield{}, fmt.Errorf("bitfield has %d bytes, expected %d for %d pieces", len(payload), (length+7)/8, length)
+	}
+
+	if length%8 != 0 {
+
+		spare := payload[len(payload)-1] << byte(length%8)
+
+		if spare != 0 {
+			return Bitfield{}, fmt.Errorf("bitfield has spare bits set after piece %d", length-1)
+		}
+	}
+
+	return Bitfield{bits: append([]byte(nil), payload...), length: length}, nil
+}
+
+// Length returns how many pieces the bitfield describes
+func (bf *Bitfield) Length() int {
+
+	return bf.length
+}
+
+// Bytes returns a copy of the bitfield as sent over the wire
+func (bf *Bitfield) Bytes() []byte {
+
+	return append([]byte(nil), bf.bits...)
+}
+
+// Clone returns a copy that can be changed independently
+func (bf *Bitfield) Clone() Bitfield {
+
+	return Bitfield{bits: bf.Bytes(), length: bf.length}
+}
+
+// HasPiece reports whether the bit for index is set. Indexes outside the bitfield are never set.
 func (bf *Bitfield) HasPiece(index int) bool {
 
+	if index < 0 || index >= bf.length {
+		return false
+	}
+
 	byteIndex := index / 8
 	offsetInByte := byte(index % 8)
 
-	containingByte := (*bf)[byteIndex]
+	containingByte := bf.bits[byteIndex]
 
 	// Clearing all the bits on its left
 	containingByte <<= offsetInByte
@@ -19,17 +77,147 @@ func (bf *Bitfield) HasPiece(index int) bool {
 	return containingByte == 1
 }
 
-func (bf *Bitfield) MarkPiece(index int) {
+// MarkPiece sets the bit for index. It reports false, changing nothing, for indexes outside the bitfield.
+func (bf *Bitfield) MarkPiece(index int) bool {
+
+	if index < 0 || index >= bf.length {
+		return false
+	}
 
 	byteIndex := index / 8
 	offsetInByte := byte(index % 8)
 
-	containingByte := (*bf)[byteIndex]
+	containingByte := bf.bits[byteIndex]
 
 	// E.g.: current byte = 10000010 ; offsetInByte = 3
 	// 		 result: 10000010 OR 00010000 = 10010010
 
 	containingByte |= byte(1 << (7 - offsetInByte))
 
-	(*bf)[byteIndex] = containingByte
+	bf.bits[byteIndex] = containingByte
+
+	return true
+}
+
+// ClearPiece unsets the bit for index. It reports false, changing nothing, for indexes outside the bitfield.
+func (bf *Bitfield) ClearPiece(index int) bool {
+
+	if index < 0 || index >= bf.length {
+		return false
+	}
+
+	bf.bits[index/8] &^= byte(1 << (7 - byte(index%8)))
+
+	return true
+}
+
+// SetRange marks every piece in [start, end) that lies within the bitfield
+func (bf *Bitfield) SetRange(start, end int) {
+
+	if start < 0 {
+		start = 0
+	}
+
+	if end > bf.length {
+		end = bf.length
+	}
+
+	for index := start; index < end; index++ {
+		bf.MarkPiece(index)
+	}
+}
+
+// Count returns the number of pieces present
+func (bf *Bitfield) Count() int {
+
+	count := 0
+
+	for _, b := range bf.bits {
+		count += bits.OnesCount8(b)
+	}
+
+	return count
+}
+
+// First returns the lowest index present, -1 when there is none
+func (bf *Bitfield) First() int {
+
+	for byteIndex, b := range bf.bits {
+
+		if b != 0 {
+			return byteIndex*8 + bits.LeadingZeros8(b)
+		}
+	}
+
+	return -1
+}
+
+// Pieces returns the indexes of all set bits in increasing order
+func (bf *Bitfield) Pieces() []int {
+
+	pieces := make([]int, 0, bf.Count())
+
+	bf.ForEach(func(index int) {
+		pieces = append(pieces, index)
+	})
+
+	return pieces
+}
+
+// ForEach calls fn with the index of every set bit, in increasing order
+func (bf *Bitfield) ForEach(fn func(index int)) {
+
+	for byteIndex, b := range bf.bits {
+
+		for b != 0 {
+
+			offset := bits.LeadingZeros8(b)
+
+			fn(byteIndex*8 + offset)
+
+			b &^= byte(0x80 >> offset)
+		}
+	}
+}
+
+// combine applies op byte by byte. The result has the length of bf, other is cut or padded with zeros to fit.
+func (bf *Bitfield) combine(other Bitfield, op func(a, b byte) byte) Bitfield {
+
+	result := NewBitfield(bf.length)
+
+	for i := range result.bits {
+
+		var b byte
+
+		if i < len(other.bits) {
+			b = other.bits[i]
+		}
+
+		result.bits[i] = op(bf.bits[i], b)
+	}
+
+	// Pieces of a longer other must not end up in the spare bits
+	if result.length%8 != 0 {
+		result.bits[len(result.bits)-1] &= byte(0xff << (8 - result.length%8))
+	}
+
+	return result
+}
+
+// And returns the pieces present in both bitfields
+func (bf *Bitfield) And(other Bitfield) Bitfield {
+
+	return bf.combine(other, func(a, b byte) byte { return a & b })
+}
+
+// AndNot returns the pieces present in bf but missing from other
+func (bf *Bitfield) AndNot(other Bitfield) Bitfield {
+
+	return bf.combine(other, func(a, b byte) byte { return a &^ b })
+}
+
+// Or returns the pieces present in either bitfield
+func (bf *Bitfield) Or(other Bitfield) Bitfield {
+
+	return bf.combine(other, func(a, b byte) byte { return a | b })
 }
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Block is the payload of a PIECE message
+type Block struct {
+	Index int
+	Begin int
+	Data  []byte
+
+	// Reserved is set when Data is the destination the caller provided.
+	// Otherwise Data should be handed back to BlockPool once used.
+	Reserved bool
+}
+
+// BlockTarget returns where the block (index, begin, length) should be decoded to, or nil
+type BlockTarget func(index, begin, length int) []byte
+
+// BlockReader reads messages off a stream, decoding PIECE payloads straight into the
+// buffers a BlockTarget hands out instead of allocating a message for each of them
+type BlockReader struct {
+	r      io.Reader
+	limits MessageLimits
+	header [13]byte
+	block  Block
+}
+
+func NewBlockReader(r io.Reader, limits MessageLimits) *BlockReader {
+
+	if limits == nil {
+		limits = unknownTorrentLimits
+	}
+
+	return &BlockReader{r: r, limits: limits}
+}
+
+// Next returns the next message or block. Both are nil for a keep-alive.
+// The returned Block is reused by the following call.
+func (br *BlockReader) Next(target BlockTarget) (*Message, *Block, error) {
+
+	// 4 bytes - length, 1 byte - ID, and for PIECE: 4 bytes - index, 4 bytes - begin
+	if _, err := io.ReadFull(br.r, br.header[:4]); err != nil {
+		return nil, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(br.header[:4])
+
+	if length == 0 {
+		return nil, nil, nil
+	}
+
+	if _, err := io.ReadFull(br.r, br.header[4:5]); err != nil {
+		return nil, nil, err
+	}
+
+	id := br.header[4]
+
+	if length > br.limits.max(id) {
+		return nil, nil, &ProtocolError{Reason: fmt.Sprintf("message ID %d with length %d exceeds limit %d", id, length, br.limits.max(id))}
+	}
+
+	if id != MsgPiece {
+
+		payload := make([]byte, length-1)
+
+		if _, err := io.ReadFull(br.r, payload); err != nil {
+			return nil, nil, err
+		}
+
+		return &Message{ID: id, Payload: payload}, nil, nil
+	}
+
+	if length < 9 {
+		return nil, nil, &ProtocolError{Reason: fmt.Sprintf("piece message too short (%d)", length)}
+	}
+
+	if _, err := io.ReadFull(br.r, br.header[5:13]); err != nil {
+		return nil, nil, err
+	}
+
+	block := &br.block
+
+	*block = Block{
+
+		Index: int(binary.BigEndian.Uint32(br.header[5:9])),
+		Begin: int(binary.BigEndian.Uint32(br.header[9:13])),
+	}
+
+	size := int(length) - 9
+
+	if target != nil {
+		block.Data = target(block.Index, block.Begin, size)
+	}
+
+	if block.Data != nil && len(block.Data) == size {
+
+		block.Reserved = true
+
+	} else if size <= BlockPool.Size() {
+
+		block.Data = BlockPool.Get(size)
+
+	} else {
+
+		block.Data = make([]byte, size)
+	}
+
+	if _, err := io.ReadFull(br.r, block.Data); err != nil {
+		return nil, nil, err
+	}
+
+	return nil, block, nil
+}
@@ -2,23 +2,129 @@ package model
 
 import (
 	"bytes"
+	"errors"
+	"example/bittorrent_in_go/mse"
+	"example/bittorrent_in_go/ratelimit"
+	"example/bittorrent_in_go/utp"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Client struct {
+	// Unix nanoseconds of the last successful read / write, accessed atomically
+	lastRead  int64
+	lastWrite int64
+
 	Connection net.Conn
-	Choked     bool
-	Bitfield   Bitfield
 	Peer       Peer
 	InfoHash   [20]byte
 	PeerID     [20]byte
+	NumPieces  int
+
+	// The ID the peer sent in its handshake
+	RemotePeerID [20]byte
+
+	// Peer state, updated by the reader goroutine
+	stateLock      sync.RWMutex
+	choked         bool
+	peerInterested bool
+	bitfield       Bitfield
+	reqq           int
+
+	limits MessageLimits
+
+	// Destinations of requested blocks, filled directly by the reader goroutine
+	reservationLock sync.Mutex
+	reservations    map[blockKey][]byte
+	outbox          chan []byte
+	closeOnce       sync.Once
+	done            chan struct{}
+
+	// Closed by whoever reads the session's events once it stops reading them
+	stop <-chan struct{}
+
+	// Why the connection was closed from our side, if because of the peer. Set before done is closed.
+	reason error
 }
 
-func connectToPeer(peer Peer) (net.Conn, error) {
+// ConnectionOptions control how connections to peers are established
+type ConnectionOptions struct {
+	Encryption mse.Policy
 
-	return net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	// PreferUTP tries a uTP connection first and only falls back to TCP when it fails
+	PreferUTP bool
+
+	// MaxMessageLengths overrides the default length limit of individual message IDs
+	MaxMessageLengths map[uint8]uint32
+
+	// RateLimits are shared with other connections, such as the process-wide and the torrent's limits
+	RateLimits []*ratelimit.Limits
+
+	// PeerDownloadLimit and PeerUploadLimit cap each connection on its own, in bytes per second, 0 for no limit
+	PeerDownloadLimit int
+	PeerUploadLimit   int
+}
+
+// limit charges all traffic of a connection, encryption and handshakes included, against the rate limits
+func (opts ConnectionOptions) limit(conn net.Conn) net.Conn {
+
+	if len(opts.RateLimits) == 0 && opts.PeerDownloadLimit == 0 && opts.PeerUploadLimit == 0 {
+		return conn
+	}
+
+	levels := append([]*ratelimit.Limits{ratelimit.NewLimits(opts.PeerDownloadLimit, opts.PeerUploadLimit)}, opts.RateLimits...)
+
+	return ratelimit.NewConn(conn, levels...)
+}
+
+// A uTP peer answers the SYN within a round trip, so there is no point in waiting as long as for TCP
+const utpDialTimeout = 2 * time.Second
+
+func connectToPeer(peer Peer, opts ConnectionOptions) (net.Conn, error) {
+
+	if opts.PreferUTP {
+
+		conn, err := utp.DialTimeout(peer.String(), utpDialTimeout)
+
+		if err == nil {
+			return opts.limit(conn), nil
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return opts.limit(conn), nil
+}
+
+func dialPeer(peer Peer, infoHash [20]byte, opts ConnectionOptions) (net.Conn, error) {
+
+	conn, err := connectToPeer(peer, opts)
+
+	if err != nil || opts.Encryption == mse.PolicyDisabled {
+		return conn, err
+	}
+
+	encrypted, err := mse.Initiate(conn, infoHash, opts.Encryption.Provide())
+
+	if err == nil {
+		return encrypted, nil
+	}
+
+	conn.Close()
+
+	if opts.Encryption == mse.PolicyRequire {
+		return nil, err
+	}
+
+	// The peer most likely doesn't speak MSE, so retry in plaintext
+	return connectToPeer(peer, opts)
 }
 
 func completeHandshake(conn net.Conn, infoHash [20]byte, peerID [20]byte) (*Handshake, error) {
@@ -37,29 +143,113 @@ func completeHandshake(conn net.Conn, infoHash [20]byte, peerID [20]byte) (*Hand
 	return ReadHandshake(conn)
 }
 
-func recvBitfield(conn net.Conn) (Bitfield, error) {
+// recvBitfield waits for the peer's bitfield. An extension handshake may come before it.
+func recvBitfield(conn net.Conn, numPieces int, limits MessageLimits) (Bitfield, *ExtendedHandshake, error) {
 
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline
 
-	msg, err := ReadMessage(conn)
+	var extended *ExtendedHandshake
+
+	for {
+
+		msg, err := ReadMessageLimited(conn, limits)
+
+		if err != nil {
+			return Bitfield{}, nil, err
+		}
+
+		if msg == nil {
+			return Bitfield{}, nil, fmt.Errorf("expected bitfield message (5) but got keep-alive")
+		}
+
+		if msg.ID == MsgExtended && extended == nil {
+
+			extended, err = msg.ParseExtendedHandshake()
+
+			if err != nil {
+				return Bitfield{}, nil, protocolError(err)
+			}
+
+			continue
+		}
+
+		if msg.ID != MsgBitfield {
+
+			return Bitfield{}, nil, fmt.Errorf("expected bitfield message (5) but got ID %d", msg.ID)
+		}
+
+		bitfield, err := ParseBitfield(msg.Payload, numPieces)
+
+		if err != nil {
+			return Bitfield{}, nil, protocolError(err)
+		}
+
+		return bitfield, extended, nil
+	}
+}
+
+// setupClient runs everything between the BitTorrent handshake and the start of the session
+func setupClient(conn net.Conn, peer Peer, infoHash, peerID [20]byte, remote *Handshake, numPieces int, opts ConnectionOptions) (*Client, error) {
+
+	limits := DefaultMessageLimits(numPieces, opts.MaxMessageLengths)
+
+	if remote.SupportsExtensions() {
+
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		_, err := conn.Write(MakeExtendedHandshakeMessage().Serialize())
+		conn.SetDeadline(time.Time{}) // Disable the deadline
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bitfield, extended, err := recvBitfield(conn, numPieces, limits)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if msg.ID != MsgBitfield {
+	client := newClient(conn, peer, infoHash, peerID, remote.PeerID, numPieces, bitfield)
+	client.limits = limits
 
-		return nil, fmt.Errorf("expected bitfield message (5) but got ID %d", msg.ID)
+	if extended != nil {
+		client.reqq = extended.Reqq
 	}
 
-	return msg.Payload, nil
+	return client, nil
 }
 
-func NewClient(peer Peer, infoHash [20]byte, peerID [20]byte, ch chan *Client) {
+// ErrSelfConnection is returned when the handshake shows we dialed one of our own listening addresses
+var ErrSelfConnection = errors.New("connected to ourselves")
+
+func newClient(conn net.Conn, peer Peer, infoHash, peerID, remotePeerID [20]byte, numPieces int, bitfield Bitfield) *Client {
+
+	now := time.Now().UnixNano()
+
+	return &Client{
+
+		lastRead:   now,
+		lastWrite:  now,
+		Connection: conn,
+		Peer:       peer,
+		InfoHash:   infoHash,
+		PeerID:     peerID,
+		NumPieces:  numPieces,
+		choked:     true,
+		bitfield:   bitfield,
+		outbox:     make(chan []byte, OutboxSize),
+		done:       make(chan struct{}),
 
-	conn, err := connectToPeer(peer)
+		RemotePeerID: remotePeerID,
+	}
+}
+
+func NewClient(peer Peer, infoHash [20]byte, numPieces int, peerID [20]byte, opts ConnectionOptions, ch chan *Client) {
+
+	conn, err := dialPeer(peer, infoHash, opts)
 
 	if err != nil {
 
@@ -73,78 +263,296 @@ func NewClient(peer Peer, infoHash [20]byte, peerID [20]byte, ch chan *Client) {
 	if err != nil {
 
 		fmt.Println(err)
+		conn.Close()
 		ch <- nil
 		return
 	}
 
 	if !bytes.Equal(response.InfoHash[:], infoHash[:]) {
 
-		fmt.Printf("expected infohash %x but got %x\n", response.InfoHash, infoHash)
+		fmt.Printf("expected infohash %x but got %x\n", infoHash, response.InfoHash)
+		conn.Close()
+		ch <- nil
+		return
+	}
+
+	if response.PeerID == peerID {
+
+		fmt.Printf("%s: %v\n", peer.String(), ErrSelfConnection)
+		conn.Close()
 		ch <- nil
 		return
 	}
 
-	bitfield, err := recvBitfield(conn)
+	client, err := setupClient(conn, peer, infoHash, peerID, response, numPieces, opts)
 
 	if err != nil {
 
 		fmt.Println(err)
+		conn.Close()
 		ch <- nil
 		return
 	}
 
-	ch <- &Client{
+	ch <- client
+}
 
-		Connection: conn,
-		Choked:     true,
-		Bitfield:   bitfield,
-		Peer:       peer,
-		InfoHash:   infoHash,
-		PeerID:     peerID,
+// AcceptClient completes an incoming connection, encrypted or not as the policy allows
+func AcceptClient(conn net.Conn, infoHash [20]byte, numPieces int, peerID [20]byte, opts ConnectionOptions) (*Client, error) {
+
+	var peer Peer
+
+	switch addr := conn.RemoteAddr().(type) {
+
+	case *net.TCPAddr:
+		peer = Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	case *net.UDPAddr:
+		peer = Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	default:
+		return nil, fmt.Errorf("unsupported remote address %s", conn.RemoteAddr())
+	}
+
+	wrapped, _, err := mse.Accept(opts.limit(conn), [][20]byte{infoHash}, opts.Encryption)
+
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped.SetDeadline(time.Now().Add(3 * time.Second))
+
+	request, err := ReadHandshake(wrapped)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(request.InfoHash[:], infoHash[:]) {
+		return nil, fmt.Errorf("expected infohash %x but got %x", infoHash, request.InfoHash)
+	}
+
+	if request.PeerID == peerID {
+		return nil, ErrSelfConnection
+	}
+
+	_, err = wrapped.Write(NewHandshake(infoHash, peerID).Serialize())
+
+	wrapped.SetDeadline(time.Time{}) // Disable the deadline
+
+	if err != nil {
+		return nil, err
+	}
+
+	return setupClient(wrapped, peer, infoHash, peerID, request, numPieces, opts)
+}
+
+// LastRead returns the time the peer last sent us anything, keep-alives included
+func (c *Client) LastRead() time.Time {
+
+	return time.Unix(0, atomic.LoadInt64(&c.lastRead))
+}
+
+// LastWrite returns the time we last sent the peer anything, keep-alives included
+func (c *Client) LastWrite() time.Time {
+
+	return time.Unix(0, atomic.LoadInt64(&c.lastWrite))
+}
+
+// Done is closed once the connection has been shut down
+func (c *Client) Done() <-chan struct{} {
+
+	return c.done
+}
+
+func (c *Client) Close() error {
+
+	return c.closeWith(nil)
+}
+
+// closeWith shuts the connection down, recording reason as the cause of the disconnect
+func (c *Client) closeWith(reason error) error {
+
+	var err error
+
+	c.closeOnce.Do(func() {
+
+		c.reason = reason
+		close(c.done)
+		err = c.Connection.Close()
+	})
+
+	return err
+}
+
+// Choked reports whether the peer is currently refusing our requests
+func (c *Client) Choked() bool {
+
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.choked
+}
+
+// PeerInterested reports whether the peer wants pieces from us
+func (c *Client) PeerInterested() bool {
+
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.peerInterested
+}
+
+func (c *Client) HasPiece(index int) bool {
+
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.bitfield.HasPiece(index)
+}
+
+// Reqq returns the request queue size the peer advertised in its extension handshake, 0 if unknown
+func (c *Client) Reqq() int {
+
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.reqq
+}
+
+// Bitfield returns a copy of the pieces the peer has announced so far
+func (c *Client) Bitfield() Bitfield {
+
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	return c.bitfield.Clone()
+}
+
+type blockKey struct {
+	index int
+	begin int
+}
+
+// Expect makes dest the destination of block (index, begin): when it arrives it is read straight
+// into dest. Register before sending the request, the block may arrive right after it.
+func (c *Client) Expect(index, begin int, dest []byte) {
+
+	c.reservationLock.Lock()
+	defer c.reservationLock.Unlock()
+
+	if c.reservations == nil {
+		c.reservations = make(map[blockKey][]byte)
 	}
+
+	c.reservations[blockKey{index, begin}] = dest
 }
 
-func (c *Client) Read() (*Message, error) {
+// Unexpect withdraws a reservation. It returns false if the block is already being read into
+// its destination, in which case a reserved EventPiece for it is still going to be delivered.
+func (c *Client) Unexpect(index, begin int) bool {
 
-	return ReadMessage(c.Connection)
+	c.reservationLock.Lock()
+	defer c.reservationLock.Unlock()
+
+	key := blockKey{index, begin}
+
+	if _, ok := c.reservations[key]; !ok {
+		return false
+	}
+
+	delete(c.reservations, key)
+
+	return true
+}
+
+// takeReservation is the reader's BlockTarget
+func (c *Client) takeReservation(index, begin, length int) []byte {
+
+	c.reservationLock.Lock()
+	defer c.reservationLock.Unlock()
+
+	key := blockKey{index, begin}
+	dest, ok := c.reservations[key]
+
+	if !ok || len(dest) != length {
+		return nil
+	}
+
+	delete(c.reservations, key)
+
+	return dest
+}
+
+// ErrOutboxFull is the reason a peer is disconnected when it takes our messages slower than we queue them
+var ErrOutboxFull = errors.New("peer is not reading, outbox full")
+
+// enqueue hands a serialized message to the writer goroutine. It never blocks the caller: a peer whose
+// outbox is full is disconnected instead.
+func (c *Client) enqueue(buf []byte) error {
+
+	select {
+
+	case <-c.done:
+		return net.ErrClosed
+
+	default:
+	}
+
+	select {
+
+	case c.outbox <- buf:
+		return nil
+
+	default:
+		c.closeWith(ErrOutboxFull)
+		return ErrOutboxFull
+	}
+}
+
+func (c *Client) SendKeepAlive() error {
+
+	return c.enqueue(MakeKeepAliveMessage())
 }
 
 func (c *Client) SendRequest(index, begin, length int) error {
 
 	req := MakeRequestMessage(index, begin, length)
 
-	_, err := c.Connection.Write(req.Serialize())
-	return err
+	return c.enqueue(req.Serialize())
+}
+
+func (c *Client) SendCancel(index, begin, length int) error {
+
+	req := MakeCancelMessage(index, begin, length)
+
+	return c.enqueue(req.Serialize())
 }
 
 func (c *Client) SendInterested() error {
 
 	msg := Message{ID: MsgInterested}
 
-	_, err := c.Connection.Write(msg.Serialize())
-	return err
+	return c.enqueue(msg.Serialize())
 }
 
 func (c *Client) SendNotInterested() error {
 
 	msg := Message{ID: MsgNotInterested}
 
-	_, err := c.Connection.Write(msg.Serialize())
-	return err
+	return c.enqueue(msg.Serialize())
 }
 
 func (c *Client) SendUnchoke() error {
 
 	msg := Message{ID: MsgUnchoke}
 
-	_, err := c.Connection.Write(msg.Serialize())
-	return err
+	return c.enqueue(msg.Serialize())
 }
 
 func (c *Client) SendHave(index int) error {
 
 	msg := MakeHaveMessage(index)
 
-	_, err := c.Connection.Write(msg.Serialize())
-	return err
+	return c.enqueue(msg.Serialize())
 }
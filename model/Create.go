@@ -0,0 +1,361 @@
+package model
+
+import (
+	"bytes"
+	"example/bittorrent_in_go/hashing"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultPieceLength is the piece length of created torrents unless asked otherwise
+const DefaultPieceLength = 256 << 10
+
+// CreateOptions describes a torrent to create
+type CreateOptions struct {
+	Announce    string
+	PieceLength int
+
+	// Align inserts padding files so that every file starts at a piece boundary (BEP 47)
+	Align bool
+
+	// Hasher hashes the pieces, hashing.Default when nil
+	Hasher *hashing.Pool
+}
+
+type createFile struct {
+	path   string
+	length int
+	parts  []string // Path inside the torrent
+	attr   string
+	link   []string // Symlink target inside the torrent
+}
+
+// CreateTorrent builds the metainfo of the file or directory at path. Directories become multi-file
+// torrents of their regular files in lexical order. Symlinks to files inside the directory are kept
+// as links, other symlinks are left out.
+func CreateTorrent(path string, options CreateOptions) ([]byte, error) {
+
+	pieceLength := options.PieceLength
+
+	if pieceLength <= 0 {
+		pieceLength = DefaultPieceLength
+	}
+
+	pool := options.Hasher
+
+	if pool == nil {
+		pool = hashing.Default
+	}
+
+	files, err := listFiles(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Align && files[0].parts != nil {
+		files = align(files, pieceLength)
+	}
+
+	total := 0
+
+	for _, file := range files {
+		total += file.length
+	}
+
+	pieces, err := hashFiles(files, total, pieceLength, pool)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info := map[string]interface{}{
+
+		"name":         filepath.Base(path),
+		"piece length": pieceLength,
+		"pieces":       pieces,
+	}
+
+	if files[0].parts == nil {
+
+		info["length"] = total
+
+		if files[0].attr != "" {
+			info["attr"] = files[0].attr
+		}
+
+	} else {
+
+		var list []interface{}
+
+		for _, file := range files {
+
+			var parts []interface{}
+
+			for _, part := range file.parts {
+				parts = append(parts, part)
+			}
+
+			entry := map[string]interface{}{"length": file.length, "path": parts}
+
+			if file.attr != "" {
+				entry["attr"] = file.attr
+			}
+
+			if file.link != nil {
+
+				var link []interface{}
+
+				for _, part := range file.link {
+					link = append(link, part)
+				}
+
+				entry["symlink path"] = link
+			}
+
+			list = append(list, entry)
+		}
+
+		info["files"] = list
+	}
+
+	return []byte(encode(map[string]interface{}{"announce": options.Announce, "info": info})), nil
+}
+
+// align puts a padding file after every file that does not end at a piece boundary, unless no data follows
+func align(files []createFile, pieceLength int) []createFile {
+
+	// Data after the end of each file
+	after := make([]int, len(files))
+
+	for i := len(files) - 2; i >= 0; i-- {
+		after[i] = after[i+1] + files[i+1].length
+	}
+
+	var aligned []createFile
+	offset := 0
+
+	for i, file := range files {
+
+		aligned = append(aligned, file)
+		offset += file.length
+
+		if after[i] == 0 || offset%pieceLength == 0 {
+			continue
+		}
+
+		pad := pieceLength - offset%pieceLength
+
+		aligned = append(aligned, createFile{length: pad, parts: []string{".pad", strconv.Itoa(pad)}, attr: "p"})
+		offset += pad
+	}
+
+	return aligned
+}
+
+func executable(mode fs.FileMode) string {
+
+	if mode&0111 != 0 {
+		return "x"
+	}
+
+	return ""
+}
+
+// listFiles returns the single file at path, or the regular files below the directory at path
+func listFiles(path string) ([]createFile, error) {
+
+	stat, err := os.Stat(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !stat.IsDir() {
+		return []createFile{{path: path, length: int(stat.Size()), attr: executable(stat.Mode())}}, nil
+	}
+
+	var files []createFile
+
+	err = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(path, file)
+
+		if err != nil {
+			return err
+		}
+
+		parts := strings.Split(rel, string(filepath.Separator))
+
+		if entry.Type()&fs.ModeSymlink != 0 {
+
+			if link := linkTarget(path, file); link != nil {
+				files = append(files, createFile{path: file, parts: parts, attr: "l", link: link})
+			}
+
+			return nil
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+
+		if err != nil {
+			return err
+		}
+
+		files = append(files, createFile{path: file, length: int(info.Size()), parts: parts, attr: executable(info.Mode())})
+
+		return nil
+	})
+
+	if err == nil && len(files) == 0 {
+		err = fs.ErrNotExist
+	}
+
+	return files, err
+}
+
+// linkTarget returns the path inside root a symlink points to, or nil when it leads out of root or nowhere
+func linkTarget(root, link string) []string {
+
+	target, err := os.Readlink(link)
+
+	if err != nil {
+		return nil
+	}
+
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(link), target)
+	}
+
+	rel, err := filepath.Rel(root, target)
+
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	return strings.Split(rel, string(filepath.Separator))
+}
+
+// hashFiles reads the files as one stream cut into pieces, hashing earlier pieces while reading the next ones
+func hashFiles(files []createFile, total, pieceLength int, pool *hashing.Pool) (string, error) {
+
+	count := (total + pieceLength - 1) / pieceLength
+	pieces := make([]byte, 20*count)
+
+	buffers := NewBufferPool(pieceLength)
+	inflight := make(chan struct{}, 2*pool.Workers())
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	index := 0
+	buf := buffers.Get(pieceLength)[:0]
+
+	submit := func() {
+
+		inflight <- struct{}{}
+		wg.Add(1)
+
+		at, piece := index, buf
+
+		pool.Submit(piece, func(sum [20]byte) {
+
+			copy(pieces[20*at:], sum[:])
+
+			buffers.Put(piece)
+			<-inflight
+			wg.Done()
+		})
+
+		index++
+		buf = buffers.Get(pieceLength)[:0]
+	}
+
+	for _, file := range files {
+
+		if file.length == 0 {
+			continue
+		}
+
+		var f io.ReadCloser = io.NopCloser(bytes.NewReader(make([]byte, file.length)))
+
+		// Padding files are zeros that exist only in the torrent
+		if file.attr != "p" {
+
+			opened, err := os.Open(file.path)
+
+			if err != nil {
+				return "", err
+			}
+
+			f = opened
+		}
+
+		// Exactly the listed length is read, the pieces were counted from it
+		limited := io.LimitReader(f, int64(file.length))
+		read := 0
+
+		for read < file.length {
+
+			n, err := io.ReadFull(limited, buf[len(buf):pieceLength])
+			buf = buf[:len(buf)+n]
+			read += n
+
+			if len(buf) == pieceLength {
+				submit()
+			}
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+
+			if err != nil {
+
+				f.Close()
+				return "", err
+			}
+		}
+
+		err := checkLength(f, file, read)
+		f.Close()
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(buf) > 0 {
+		submit()
+	}
+
+	wg.Wait()
+
+	return string(pieces), nil
+}
+
+// checkLength fails when a file turned out shorter or longer than listed, having read read bytes of it
+func checkLength(f io.Reader, file createFile, read int) error {
+
+	if read == file.length {
+
+		if n, _ := f.Read(make([]byte, 1)); n == 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s changed while hashing", file.path)
+}
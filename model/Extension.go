@@ -0,0 +1,76 @@
+package model
+
+import (
+	"fmt"
+)
+
+/*
+	Extension protocol, as specified in BEP 10:
+	https://www.bittorrent.org/beps/bep_0010.html
+*/
+
+const MsgExtended uint8 = 20
+
+// extendedHandshakeID is the extended message ID reserved for the extension handshake itself
+const extendedHandshakeID = 0
+
+// OurReqq is the number of outstanding requests we are willing to queue for a peer
+const OurReqq = 250
+
+// ExtendedHandshake holds the parts of a peer's extension handshake we use
+type ExtendedHandshake struct {
+	Reqq    int
+	Version string
+}
+
+func MakeExtendedHandshakeMessage() *Message {
+
+	dict := map[string]interface{}{
+
+		"m":    map[string]interface{}{},
+		"reqq": OurReqq,
+		"v":    fmt.Sprintf("%s %s", ClientCode, ClientVersion),
+	}
+
+	payload := append([]byte{extendedHandshakeID}, encode(dict)...)
+
+	return &Message{ID: MsgExtended, Payload: payload}
+}
+
+// ParseExtendedHandshake returns nil without error for extended messages other than the handshake
+func (msg *Message) ParseExtendedHandshake() (*ExtendedHandshake, error) {
+
+	if msg.ID != MsgExtended {
+		return nil, fmt.Errorf("expected EXTENDED (%d), got ID %d", MsgExtended, msg.ID)
+	}
+
+	if len(msg.Payload) < 1 {
+		return nil, fmt.Errorf("extended message without an extended ID")
+	}
+
+	if msg.Payload[0] != extendedHandshakeID {
+		return nil, nil
+	}
+
+	data, err := decodeSafely(string(msg.Payload[1:]))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if data.t != "d" {
+		return nil, fmt.Errorf("extension handshake is not a dictionary")
+	}
+
+	hs := &ExtendedHandshake{
+
+		Reqq:    data.d["reqq"].i,
+		Version: data.d["v"].s,
+	}
+
+	if hs.Reqq < 0 {
+		hs.Reqq = 0
+	}
+
+	return hs, nil
+}
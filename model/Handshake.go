@@ -7,18 +7,34 @@ import (
 
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+const protocolName = "BitTorrent protocol"
+
+// extensionProtocolBit is the reserved bit announcing BEP 10 support (20th bit from the right)
+const extensionProtocolBit = 0x10
+
 func NewHandshake(infoHash, peerID [20]byte) *Handshake {
 
-	return &Handshake{
+	hs := &Handshake{
 
-		Pstr:     "BitTorrent protocol",
+		Pstr:     protocolName,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+
+	hs.Reserved[5] |= extensionProtocolBit
+
+	return hs
+}
+
+// SupportsExtensions reports whether the sender speaks the extension protocol
+func (hs *Handshake) SupportsExtensions() bool {
+
+	return hs.Reserved[5]&extensionProtocolBit != 0
 }
 
 func (hs *Handshake) Serialize() []byte {
@@ -37,7 +53,7 @@ func (hs *Handshake) Serialize() []byte {
 	index := 1
 
 	index += copy(buf[index:], hs.Pstr)
-	index += copy(buf[index:], make([]byte, 8))
+	index += copy(buf[index:], hs.Reserved[:])
 	index += copy(buf[index:], hs.InfoHash[:])
 	index += copy(buf[index:], hs.PeerID[:])
 
@@ -55,9 +71,9 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 	}
 
 	protocolLength := int(hexLength[0])
-	if protocolLength == 0 {
+	if protocolLength != len(protocolName) {
 
-		return nil, fmt.Errorf("protocolLength cannot be 0")
+		return nil, &ProtocolError{Reason: fmt.Sprintf("unexpected protocol string length %d", protocolLength)}
 	}
 
 	// Allocating buffer for protocol name, 8 reserved bytes, infohash and peer ID
@@ -69,13 +85,21 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	if string(handshakeBuf[0:protocolLength]) != protocolName {
+
+		return nil, &ProtocolError{Reason: fmt.Sprintf("unknown protocol %q", handshakeBuf[0:protocolLength])}
+	}
+
+	copy(reserved[:], handshakeBuf[protocolLength:protocolLength+8])
 	copy(infoHash[:], handshakeBuf[protocolLength+8:protocolLength+8+20])
 	copy(peerID[:], handshakeBuf[protocolLength+8+20:])
 
 	hs := Handshake{
 		Pstr:     string(handshakeBuf[0:protocolLength]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -23,6 +23,73 @@ type Message struct {
 	Payload []byte
 }
 
+// ProtocolError reports a peer breaking the wire protocol, as opposed to the connection failing
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+
+	return "protocol violation: " + e.Reason
+}
+
+func protocolError(err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	return &ProtocolError{Reason: err.Error()}
+}
+
+// MaxBlockLength is the largest PIECE block we accept. We never request more than 16 KiB,
+// but some clients serve larger blocks to peers that ask for them.
+const MaxBlockLength = 1 << 17
+
+// MaxExtendedLength bounds extension protocol messages
+const MaxExtendedLength = 1 << 16
+
+// defaultMaxLength applies to message IDs we don't know
+const defaultMaxLength = 1 << 16
+
+// MessageLimits maps a message ID to the largest length prefix (ID byte included) allowed for it
+type MessageLimits map[uint8]uint32
+
+// DefaultMessageLimits returns the limits for a torrent with numPieces pieces, with overrides applied
+func DefaultMessageLimits(numPieces int, overrides map[uint8]uint32) MessageLimits {
+
+	limits := MessageLimits{
+
+		MsgChoke:         1,
+		MsgUnchoke:       1,
+		MsgInterested:    1,
+		MsgNotInterested: 1,
+		MsgHave:          1 + 4,
+		MsgBitfield:      1 + uint32((numPieces+7)/8),
+		MsgRequest:       1 + 12,
+		MsgPiece:         1 + 8 + MaxBlockLength,
+		MsgCancel:        1 + 12,
+		MsgExtended:      1 + MaxExtendedLength,
+	}
+
+	for id, length := range overrides {
+		limits[id] = length
+	}
+
+	return limits
+}
+
+var unknownTorrentLimits = DefaultMessageLimits(1<<20, nil)
+
+func (limits MessageLimits) max(id uint8) uint32 {
+
+	if length, ok := limits[id]; ok {
+		return length
+	}
+
+	return defaultMaxLength
+}
+
 func (msg *Message) Serialize() (buffer []byte) {
 
 	// Message string:
@@ -44,36 +111,61 @@ func (msg *Message) Serialize() (buffer []byte) {
 
 }
 
+// ReadMessage reads a message with the limits of an unknown torrent size
 func ReadMessage(r io.Reader) (msg *Message, err error) {
 
-	lenBuffer := make([]byte, 4)
+	return ReadMessageLimited(r, nil)
+}
+
+// ReadMessageLimited checks the length prefix against limits before allocating anything.
+// A nil limits only bounds the message by its ID with the default limits for 2^20 pieces.
+func ReadMessageLimited(r io.Reader, limits MessageLimits) (msg *Message, err error) {
+
+	if limits == nil {
+		limits = unknownTorrentLimits
+	}
+
+	lenBuffer := make([]byte, 5)
 
 	// Reading message length from the ID onward
-	_, err = io.ReadFull(r, lenBuffer)
+	_, err = io.ReadFull(r, lenBuffer[:4])
 
 	if err != nil {
 
 		return
 	}
 
-	msgLength := binary.BigEndian.Uint32(lenBuffer)
+	msgLength := binary.BigEndian.Uint32(lenBuffer[:4])
 
+	// A zero length message is a keep-alive, reported as a nil message
 	if msgLength == 0 {
 
 		return
 	}
 
-	msgBuffer := make([]byte, msgLength)
-
-	_, err = io.ReadFull(r, msgBuffer)
+	_, err = io.ReadFull(r, lenBuffer[4:])
 
 	if err != nil {
 
 		return
 	}
 
-	id := uint8(msgBuffer[0])
-	payload := msgBuffer[1:]
+	id := uint8(lenBuffer[4])
+
+	if msgLength > limits.max(id) {
+
+		err = &ProtocolError{Reason: fmt.Sprintf("message ID %d with length %d exceeds limit %d", id, msgLength, limits.max(id))}
+		return
+	}
+
+	payload := make([]byte, msgLength-1)
+
+	_, err = io.ReadFull(r, payload)
+
+	if err != nil {
+
+		return
+	}
 
 	msg = new(Message)
 	msg.ID = id
@@ -82,6 +174,12 @@ func ReadMessage(r io.Reader) (msg *Message, err error) {
 	return
 }
 
+// MakeKeepAliveMessage returns the wire form of a keep-alive: a zero length prefix with no ID
+func MakeKeepAliveMessage() []byte {
+
+	return make([]byte, 4)
+}
+
 func MakeRequestMessage(index, begin, length int) *Message {
 
 	payload := make([]byte, 12)
@@ -93,6 +191,14 @@ func MakeRequestMessage(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+func MakeCancelMessage(index, begin, length int) *Message {
+
+	msg := MakeRequestMessage(index, begin, length)
+	msg.ID = MsgCancel
+
+	return msg
+}
+
 func MakeHaveMessage(index int) *Message {
 
 	payload := make([]byte, 4)
@@ -145,3 +251,39 @@ func (msg *Message) ParseHave() (int, error) {
 
 	return index, nil
 }
+
+// ParseRequest extracts index, begin and length from a REQUEST or CANCEL message
+func (msg *Message) ParseRequest() (index, begin, length int, err error) {
+
+	if msg.ID != MsgRequest && msg.ID != MsgCancel {
+		return 0, 0, 0, fmt.Errorf("expected REQUEST (%d) or CANCEL (%d), got ID %d", MsgRequest, MsgCancel, msg.ID)
+	}
+
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12, got length %d", len(msg.Payload))
+	}
+
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+
+	return
+}
+
+// ParsePiece splits a PIECE message into its header and the block it carries, without copying
+func (msg *Message) ParsePiece() (index, begin int, block []byte, err error) {
+
+	if msg.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("expected PIECE (%d), got ID %d", MsgPiece, msg.ID)
+	}
+
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("payload too short. %d < 8", len(msg.Payload))
+	}
+
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	block = msg.Payload[8:]
+
+	return
+}
@@ -0,0 +1,36 @@
+package model
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// ClientCode identifies this client in Azureus-style peer IDs. It must not be one already registered to
+// another client, or peers would take us for it.
+const ClientCode = "GQ"
+
+// ClientVersion is encoded as four digits in the peer ID (major, minor, patch, build)
+const ClientVersion = "0100"
+
+const peerIDAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// NewPeerID generates a peer ID of the form -GQ0100-xxxxxxxxxxxx with a random 12 character suffix
+func NewPeerID() ([20]byte, error) {
+
+	var id [20]byte
+
+	prefix := fmt.Sprintf("-%s%s-", ClientCode, ClientVersion)
+	n := copy(id[:], prefix)
+
+	random := make([]byte, len(id)-n)
+
+	if _, err := rand.Read(random); err != nil {
+		return id, err
+	}
+
+	for i, b := range random {
+		id[n+i] = peerIDAlphabet[int(b)%len(peerIDAlphabet)]
+	}
+
+	return id, nil
+}
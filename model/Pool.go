@@ -0,0 +1,50 @@
+package model
+
+import "sync"
+
+// BufferPool recycles byte slices of one fixed capacity
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func NewBufferPool(size int) *BufferPool {
+
+	p := &BufferPool{size: size}
+
+	p.pool.New = func() interface{} {
+
+		buf := make([]byte, size)
+		return &buf
+	}
+
+	return p
+}
+
+// Get returns a buffer of length n, which must not exceed the pool's size
+func (p *BufferPool) Get(n int) []byte {
+
+	buf := *p.pool.Get().(*[]byte)
+
+	return buf[:n]
+}
+
+// Put hands a buffer back. Buffers that did not come from this pool are left to the GC.
+func (p *BufferPool) Put(buf []byte) {
+
+	if cap(buf) != p.size {
+		return
+	}
+
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
+
+func (p *BufferPool) Size() int {
+
+	return p.size
+}
+
+// BlockPool holds buffers for blocks that arrive without a reserved destination. They are the size we
+// request. The rare larger block, up to MaxBlockLength, gets a buffer of its own that Put leaves to the GC.
+var BlockPool = NewBufferPool(BlockSize)
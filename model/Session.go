@@ -0,0 +1,330 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// OutboxSize is the number of serialized messages that can wait for the writer goroutine. A peer that
+// lets more pile up is not reading and gets disconnected.
+const OutboxSize = 1024
+
+type EventType uint8
+
+const (
+	EventChoked EventType = iota
+	EventUnchoked
+	EventInterested
+	EventNotInterested
+	EventHave
+	EventBitfield
+	EventPiece
+	EventRequest
+	EventCancel
+	EventDisconnected
+)
+
+// Event is something a peer did, delivered to the scheduler as soon as it is read off the wire
+type Event struct {
+	Type   EventType
+	Client *Client
+
+	// HAVE: Index. REQUEST / CANCEL: Index, Begin, Length. PIECE: Index, Begin, Data, Reserved
+	Index  int
+	Begin  int
+	Length int
+	Data   []byte
+
+	// Data was read into the destination registered with Expect. Otherwise it belongs to BlockPool.
+	Reserved bool
+
+	// Why the peer disconnected
+	Err error
+}
+
+func (t EventType) String() string {
+
+	switch t {
+
+	case EventChoked:
+		return "choked"
+	case EventUnchoked:
+		return "unchoked"
+	case EventInterested:
+		return "interested"
+	case EventNotInterested:
+		return "not interested"
+	case EventHave:
+		return "have"
+	case EventBitfield:
+		return "bitfield"
+	case EventPiece:
+		return "piece"
+	case EventRequest:
+		return "request"
+	case EventCancel:
+		return "cancel"
+	case EventDisconnected:
+		return "disconnected"
+	}
+
+	return fmt.Sprintf("EventType(%d)", t)
+}
+
+// Start runs the session: a reader goroutine turning messages into events, and a writer goroutine
+// draining the outbox and sending keep-alives after keepAlive without writes. The peer is disconnected
+// once it has been silent, or has not taken a write, for longer than idleTimeout. EventDisconnected is
+// always the last event. Once stop is closed events are no longer delivered, and the session closes
+// the connection instead of delivering the next one.
+func (c *Client) Start(events chan<- Event, stop <-chan struct{}, keepAlive, idleTimeout time.Duration) {
+
+	c.stop = stop
+
+	go c.writeLoop(keepAlive, idleTimeout)
+	go c.readLoop(events, idleTimeout)
+}
+
+// ErrIdle is the reason a peer is disconnected after sending nothing for longer than the idle timeout
+var ErrIdle = errors.New("peer has been silent for too long")
+
+// idleReader fails once nothing arrives for timeout. The deadline lives on the connection, so it
+// applies whatever the writer goroutine is stuck on.
+type idleReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+
+	n, err := r.conn.Read(p)
+
+	if timeout, ok := err.(net.Error); ok && timeout.Timeout() {
+		err = fmt.Errorf("%w: nothing received for %s", ErrIdle, r.timeout)
+	}
+
+	return n, err
+}
+
+func (c *Client) emit(events chan<- Event, event Event) bool {
+
+	event.Client = c
+
+	select {
+
+	case events <- event:
+		return true
+
+	case <-c.done:
+		return false
+
+	case <-c.stop:
+		return false
+	}
+}
+
+func (c *Client) readLoop(events chan<- Event, idleTimeout time.Duration) {
+
+	err := c.readMessages(events, idleTimeout)
+
+	c.Close()
+
+	// The connection was shut down because of the peer, which explains the read error
+	if c.reason != nil {
+		err = c.reason
+	}
+
+	// Delivered even after Close, so the scheduler always learns about the disconnect while it listens
+	select {
+	case events <- Event{Type: EventDisconnected, Client: c, Err: err}:
+	case <-c.stop:
+	}
+}
+
+func (c *Client) readMessages(events chan<- Event, idleTimeout time.Duration) error {
+
+	if !c.emit(events, Event{Type: EventBitfield}) {
+		return nil
+	}
+
+	var conn io.Reader = c.Connection
+
+	if idleTimeout > 0 {
+		conn = idleReader{c.Connection, idleTimeout}
+	}
+
+	reader := NewBlockReader(conn, c.limits)
+
+	for {
+
+		msg, block, err := reader.Next(c.takeReservation)
+
+		if err != nil {
+			return err
+		}
+
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+
+		if block != nil {
+
+			event := Event{Type: EventPiece, Index: block.Index, Begin: block.Begin, Data: block.Data, Reserved: block.Reserved}
+
+			if !c.emit(events, event) {
+				return nil
+			}
+
+			continue
+		}
+
+		// Keep-alive
+		if msg == nil {
+			continue
+		}
+
+		event, err := c.handleMessage(msg)
+
+		if err != nil {
+			return protocolError(err)
+		}
+
+		if event == nil {
+			continue
+		}
+
+		if !c.emit(events, *event) {
+			return nil
+		}
+	}
+}
+
+// handleMessage applies a message to the peer state and describes it as an event.
+// PIECE messages never get here, the BlockReader turns them into blocks.
+func (c *Client) handleMessage(msg *Message) (*Event, error) {
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	switch msg.ID {
+
+	case MsgChoke:
+		c.choked = true
+		return &Event{Type: EventChoked}, nil
+
+	case MsgUnchoke:
+		c.choked = false
+		return &Event{Type: EventUnchoked}, nil
+
+	case MsgInterested:
+		c.peerInterested = true
+		return &Event{Type: EventInterested}, nil
+
+	case MsgNotInterested:
+		c.peerInterested = false
+		return &Event{Type: EventNotInterested}, nil
+
+	case MsgHave:
+		index, err := msg.ParseHave()
+		if err != nil {
+			return nil, err
+		}
+
+		if !c.bitfield.MarkPiece(index) {
+			return nil, fmt.Errorf("have for piece %d, torrent only has %d", index, c.bitfield.Length())
+		}
+		return &Event{Type: EventHave, Index: index}, nil
+
+	case MsgBitfield:
+		bitfield, err := ParseBitfield(msg.Payload, c.NumPieces)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.bitfield = bitfield
+		return &Event{Type: EventBitfield}, nil
+
+	case MsgRequest, MsgCancel:
+		index, begin, length, err := msg.ParseRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		eventType := EventRequest
+		if msg.ID == MsgCancel {
+			eventType = EventCancel
+		}
+
+		return &Event{Type: eventType, Index: index, Begin: begin, Length: length}, nil
+
+	case MsgExtended:
+		extended, err := msg.ParseExtendedHandshake()
+		if err != nil {
+			return nil, err
+		}
+
+		if extended != nil {
+			c.reqq = extended.Reqq
+		}
+
+		return nil, nil
+	}
+
+	// Unknown or unsupported messages are ignored
+	return nil, nil
+}
+
+func (c *Client) writeLoop(keepAlive, idleTimeout time.Duration) {
+
+	var err error
+
+	defer func() { c.closeWith(err) }()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+
+		case <-c.done:
+			return
+
+		case buf := <-c.outbox:
+
+			if err = c.write(buf, idleTimeout); err != nil {
+				return
+			}
+
+		case now := <-ticker.C:
+
+			if keepAlive > 0 && now.Sub(c.LastWrite()) >= keepAlive {
+
+				if err = c.write(MakeKeepAliveMessage(), idleTimeout); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// write sends buf, giving up once the peer has not taken it for timeout. Without a deadline a peer that
+// stops reading blocks the writer for good as soon as the socket buffer is full.
+func (c *Client) write(buf []byte, timeout time.Duration) error {
+
+	if timeout > 0 {
+		c.Connection.SetWriteDeadline(time.Now().Add(timeout))
+	}
+
+	_, err := c.Connection.Write(buf)
+
+	if err == nil {
+		atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+	}
+
+	return err
+}
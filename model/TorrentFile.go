@@ -6,10 +6,15 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// BlockSize is the number of bytes requested from a peer at once. Only the last block of a piece may be shorter.
+const BlockSize = 16384
+
 type TorrentFile struct {
 	Announce    string
 	InfoHash    [20]byte
@@ -17,6 +22,62 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+
+	// The content is all files concatenated. Single-file torrents have one file named Name.
+	Files []FileEntry
+}
+
+// FileEntry is one file of a torrent
+type FileEntry struct {
+	Path   string // Relative to the download directory
+	Length int
+	Offset int // Where the file starts in the torrent's content
+
+	// BEP 47 attributes: p for padding, x for executable, h for hidden and l for symlink
+	Attr string
+
+	// Target of a symlink, relative to the download directory like Path
+	Symlink string
+
+	// SHA-1 of the whole file when the torrent has one, nil otherwise
+	SHA1 []byte
+}
+
+// Padding files only align the next file to a piece boundary and hold zeros
+func (entry FileEntry) Padding() bool {
+
+	return strings.ContainsRune(entry.Attr, 'p')
+}
+
+func (entry FileEntry) Executable() bool {
+
+	return strings.ContainsRune(entry.Attr, 'x')
+}
+
+func (entry FileEntry) Hidden() bool {
+
+	return strings.ContainsRune(entry.Attr, 'h')
+}
+
+// IsSymlink tells whether the file is a link to Symlink rather than data
+func (entry FileEntry) IsSymlink() bool {
+
+	return strings.ContainsRune(entry.Attr, 'l') && entry.Symlink != ""
+}
+
+// OnDisk tells whether the file is kept as a regular file, which padding files and symlinks are not
+func (entry FileEntry) OnDisk() bool {
+
+	return !entry.Padding() && !entry.IsSymlink()
+}
+
+func fileHash(sha string) []byte {
+
+	if len(sha) != 20 {
+		return nil
+	}
+
+	return []byte(sha)
 }
 
 type bencodeTrackerResp struct {
@@ -35,6 +96,30 @@ func MakeTorrentFile(path string) (torrent *TorrentFile) {
 	torrent.Name = bto.Info.Name
 	torrent.PieceLength = bto.Info.PieceLength
 
+	if len(bto.Info.Files) == 0 {
+
+		torrent.Files = []FileEntry{{Path: safePath(torrent.Name), Length: torrent.Length, Attr: bto.Info.Attr, SHA1: fileHash(bto.Info.Sha1)}}
+
+	} else {
+
+		torrent.Length = 0
+
+		for _, file := range bto.Info.Files {
+
+			path := safePath(append([]string{torrent.Name}, file.Path...)...)
+
+			entry := FileEntry{Path: path, Length: file.Length, Offset: torrent.Length, Attr: file.Attr, SHA1: fileHash(file.Sha1)}
+
+			// Links point inside the torrent, relative to its root directory
+			if len(file.SymlinkPath) > 0 {
+				entry.Symlink = safePath(append([]string{torrent.Name}, file.SymlinkPath...)...)
+			}
+
+			torrent.Files = append(torrent.Files, entry)
+			torrent.Length += file.Length
+		}
+	}
+
 	p := bto.Info.Pieces
 
 	for p != "" {
@@ -53,6 +138,104 @@ func MakeTorrentFile(path string) (torrent *TorrentFile) {
 	return
 }
 
+// safePath joins path components from a torrent so the result always stays inside the download
+// directory. Components that would escape it are replaced rather than dropped to keep the layout.
+func safePath(components ...string) string {
+
+	safe := make([]string, len(components))
+
+	for i, component := range components {
+
+		component = strings.Map(func(r rune) rune {
+
+			if r == '/' || r == '\\' || r == 0 {
+				return '_'
+			}
+
+			return r
+		}, component)
+
+		if component == "" || component == "." || component == ".." {
+			component = "_"
+		}
+
+		safe[i] = component
+	}
+
+	return filepath.Join(safe...)
+}
+
+// ContentFiles returns Files, or a single file named Name for torrents built without a file list
+func (file *TorrentFile) ContentFiles() []FileEntry {
+
+	if len(file.Files) == 0 {
+		return []FileEntry{{Path: safePath(file.Name), Length: file.Length}}
+	}
+
+	return file.Files
+}
+
+// FilePieces returns the range [first, last] of pieces that hold data of a file. Empty files have none, last < first.
+func (file *TorrentFile) FilePieces(index int) (first, last int) {
+
+	entry := file.ContentFiles()[index]
+
+	first = entry.Offset / file.PieceLength
+	last = (entry.Offset + entry.Length - 1) / file.PieceLength
+
+	if entry.Length == 0 {
+		last = first - 1
+	}
+
+	return first, last
+}
+
+// NumPieces is the number of pieces Length splits into, which PieceHashes must match
+func (file *TorrentFile) NumPieces() int {
+
+	return (file.Length + file.PieceLength - 1) / file.PieceLength
+}
+
+// PieceBounds returns the byte range [begin, end) a piece covers in the torrent's content
+func (file *TorrentFile) PieceBounds(index int) (begin, end int) {
+
+	begin = index * file.PieceLength
+	end = begin + file.PieceLength
+
+	// The final piece holds whatever is left
+	if end > file.Length {
+		end = file.Length
+	}
+
+	return begin, end
+}
+
+// PieceSize is the length of a piece, shorter than PieceLength only for the final piece
+func (file *TorrentFile) PieceSize(index int) int {
+
+	begin, end := file.PieceBounds(index)
+
+	return end - begin
+}
+
+// BlockCount is the number of blocks a piece is requested in
+func (file *TorrentFile) BlockCount(index int) int {
+
+	return (file.PieceSize(index) + BlockSize - 1) / BlockSize
+}
+
+// BlockSize is the length of a block of a piece, shorter than BlockSize only for the final block
+func (file *TorrentFile) BlockSize(index, block int) int {
+
+	size := file.PieceSize(index) - block*BlockSize
+
+	if size > BlockSize {
+		return BlockSize
+	}
+
+	return size
+}
+
 func (file *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
 
 	base, err := url.Parse(file.Announce)
@@ -1,8 +1,10 @@
 package model
 
 import (
+	"fmt"
 	"io/ioutil"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -20,12 +22,23 @@ type decodedVariant struct {
 	l []decodedVariant
 }
 
+type bencodeFile struct {
+	Length      int
+	Path        []string
+	Attr        string
+	SymlinkPath []string
+	Sha1        string
+}
+
 type bencodeInfo struct {
 	Encoded     string
 	Pieces      string
 	PieceLength int
 	Length      int
 	Name        string
+	Attr        string
+	Sha1        string
+	Files       []bencodeFile
 }
 
 type bencodeTorrent struct {
@@ -38,60 +51,55 @@ type bencodeTorrent struct {
 
 func tokenize(text string, c chan string) {
 
-	expr1 := "[idel]"
-	expr2 := "\\d+:"
-	expr3 := "\\d+"
-
-	re1, _ := regexp.Compile(expr1)
-	re2, _ := regexp.Compile(expr2)
-	re3, _ := regexp.Compile(expr3)
+	// Every token starts right at the front of the remaining text
+	re1 := regexp.MustCompile("^[idel]")
+	re2 := regexp.MustCompile("^\\d+:")
+	re3 := regexp.MustCompile("^-?\\d+")
 
 	for text != "" {
 
-		m1 := string(re1.Find([]byte(text)))
-		m2 := string(re2.Find([]byte(text)))
-		m3 := string(re3.Find([]byte(text)))
+		m1 := re1.FindString(text)
+		m2 := re2.FindString(text)
+		m3 := re3.FindString(text)
 
-		i1 := strings.Index(text, m1)
-		i2 := strings.Index(text, m2)
-		i3 := strings.Index(text, m3)
-
-		if (i1 < i2 && i1 < i3) || (m2 == "" && m3 == "") {
+		if m1 != "" {
 
 			c <- m1
 			text = text[1:]
 
-		} else if i3 < i1 && i3 < i2 {
-
-			c <- m3
-			text = text[len(m3):]
+		} else if m2 != "" {
 
-		} else {
+			lenStr := m2[:len(m2)-1]
 
-			if m2 != "" {
+			length, err := strconv.Atoi(lenStr)
 
-				c <- "s"
+			// A truncated string or a bogus length ends the token stream, the decoder reports the error
+			if err != nil || length > len(text)-len(m2) {
+				break
+			}
 
-				lenStr := m2[:len(m2)-1]
+			c <- "s"
 
-				length, _ := strconv.Atoi(lenStr)
+			if length != 0 {
 
-				if length != 0 {
+				c <- text[len(m2) : len(m2)+length]
 
-					c <- text[len(lenStr)+1 : length+len(lenStr)+1]
+			} else {
 
-				} else {
+				c <- "<nil>"
+			}
 
-					c <- "<nil>"
-				}
+			text = text[length+len(m2):]
 
-				text = text[length+len(m2):]
+		} else if m3 != "" {
 
-			} else {
+			c <- m3
+			text = text[len(m3):]
 
-				text = ""
-			}
+		} else {
 
+			// Not bencode
+			break
 		}
 	}
 
@@ -187,6 +195,87 @@ func decodeItem(tokens []string) (data *decodedVariant, newTokens []string) {
 	return
 }
 
+// decodeSafely decodes a single bencoded value coming from the network, turning malformed input into an error
+func decodeSafely(bencode string) (data *decodedVariant, err error) {
+
+	defer func() {
+
+		if r := recover(); r != nil {
+			data, err = nil, fmt.Errorf("malformed bencode: %v", r)
+		}
+	}()
+
+	tokens := decode(bencode)
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("malformed bencode: empty input")
+	}
+
+	data, _ = decodeItem(tokens)
+
+	if data == nil {
+		return nil, fmt.Errorf("malformed bencode: unexpected token %q", tokens[0])
+	}
+
+	return data, nil
+}
+
+// encode bencodes ints, strings, byte slices, lists and string-keyed dictionaries (keys sorted)
+func encode(value interface{}) string {
+
+	var sb strings.Builder
+
+	encodeInto(&sb, value)
+
+	return sb.String()
+}
+
+func encodeInto(sb *strings.Builder, value interface{}) {
+
+	switch v := value.(type) {
+
+	case int:
+		sb.WriteString("i" + strconv.Itoa(v) + "e")
+
+	case string:
+		sb.WriteString(strconv.Itoa(len(v)) + ":" + v)
+
+	case []byte:
+		encodeInto(sb, string(v))
+
+	case []interface{}:
+		sb.WriteString("l")
+
+		for _, item := range v {
+			encodeInto(sb, item)
+		}
+
+		sb.WriteString("e")
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+
+		for key := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		sb.WriteString("d")
+
+		for _, key := range keys {
+
+			encodeInto(sb, key)
+			encodeInto(sb, v[key])
+		}
+
+		sb.WriteString("e")
+
+	default:
+		panic(fmt.Sprintf("cannot bencode %T", value))
+	}
+}
+
 func createObjects(tokens []string) *bencodeTorrent {
 
 	data, _ := decodeItem(tokens)
@@ -212,6 +301,24 @@ func createObjects(tokens []string) *bencodeTorrent {
 	info.Name = dataInfo["name"].s
 	info.PieceLength = dataInfo["piece length"].i
 	info.Pieces = dataInfo["pieces"].s
+	info.Attr = dataInfo["attr"].s
+	info.Sha1 = dataInfo["sha1"].s
+
+	// Multi-file torrents list their files instead of a length
+	for _, f := range dataInfo["files"].l {
+
+		file := bencodeFile{Length: f.d["length"].i, Attr: f.d["attr"].s, Sha1: f.d["sha1"].s}
+
+		for _, component := range f.d["path"].l {
+			file.Path = append(file.Path, component.s)
+		}
+
+		for _, component := range f.d["symlink path"].l {
+			file.SymlinkPath = append(file.SymlinkPath, component.s)
+		}
+
+		info.Files = append(info.Files, file)
+	}
 
 	torrent.Info = info
 
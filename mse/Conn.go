@@ -0,0 +1,62 @@
+package mse
+
+import (
+	"crypto/rc4"
+	"net"
+	"sync"
+)
+
+// Conn is a peer connection after the MSE handshake. When RC4 was negotiated every byte
+// is passed through the stream ciphers, otherwise it behaves like the underlying connection.
+type Conn struct {
+	net.Conn
+
+	// Already decrypted bytes that arrived during the handshake (initial payload)
+	pending []byte
+
+	encrypt *rc4.Cipher
+	decrypt *rc4.Cipher
+
+	writeLock sync.Mutex
+}
+
+func (c *Conn) Encrypted() bool {
+
+	return c.encrypt != nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+
+	if len(c.pending) > 0 {
+
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(b)
+
+	if c.decrypt != nil && n > 0 {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+
+	// The cipher state advances with every byte, so writes must not interleave
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	// Never encrypt the caller's buffer in place
+	buf := make([]byte, len(b))
+	c.encrypt.XORKeyStream(buf, b)
+
+	return c.Conn.Write(buf)
+}
@@ -0,0 +1,444 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+/*
+	Message Stream Encryption, as specified in:
+	https://wiki.vuze.com/w/Message_Stream_Encryption
+*/
+
+type Policy int
+
+const (
+	// PolicyDisabled only ever speaks the plaintext protocol
+	PolicyDisabled Policy = iota
+
+	// PolicyPrefer negotiates RC4 when possible and falls back to plaintext otherwise
+	PolicyPrefer
+
+	// PolicyRequire refuses every connection that is not RC4 encrypted
+	PolicyRequire
+)
+
+// crypto_provide / crypto_select bits
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+// HandshakeTimeout bounds the whole key exchange
+const HandshakeTimeout = 10 * time.Second
+
+const keySize = 96
+const maxPadSize = 512
+
+var prime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA6"+
+		"3B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C24"+
+		"5E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+var generator = big.NewInt(2)
+
+// The verification constant, 8 zero bytes
+var vc = make([]byte, 8)
+
+var ErrNotAllowed = errors.New("mse: no crypto method allowed by both sides")
+
+func (p Policy) String() string {
+
+	switch p {
+
+	case PolicyDisabled:
+		return "disabled"
+
+	case PolicyPrefer:
+		return "prefer"
+
+	case PolicyRequire:
+		return "require"
+	}
+
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// Provide returns the crypto methods a policy lets us offer or accept
+func (p Policy) Provide() uint32 {
+
+	switch p {
+
+	case PolicyPrefer:
+		return CryptoRC4 | CryptoPlaintext
+
+	case PolicyRequire:
+		return CryptoRC4
+	}
+
+	return CryptoPlaintext
+}
+
+func hash(parts ...[]byte) []byte {
+
+	h := sha1.New()
+
+	for _, part := range parts {
+		h.Write(part)
+	}
+
+	return h.Sum(nil)
+}
+
+func newKeyPair() (private *big.Int, public []byte, err error) {
+
+	// A 160 bit exponent, as recommended by the specification
+	privateBytes := make([]byte, 20)
+
+	if _, err = rand.Read(privateBytes); err != nil {
+		return
+	}
+
+	private = new(big.Int).SetBytes(privateBytes)
+	public = paddedBytes(new(big.Int).Exp(generator, private, prime))
+
+	return
+}
+
+func sharedSecret(remotePublic []byte, private *big.Int) []byte {
+
+	y := new(big.Int).SetBytes(remotePublic)
+
+	return paddedBytes(new(big.Int).Exp(y, private, prime))
+}
+
+// paddedBytes writes n as a big-endian number on exactly keySize bytes
+func paddedBytes(n *big.Int) []byte {
+
+	buf := make([]byte, keySize)
+	b := n.Bytes()
+
+	copy(buf[keySize-len(b):], b)
+
+	return buf
+}
+
+func randomPad() ([]byte, error) {
+
+	var n [2]byte
+
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadSize+1))
+
+	_, err := rand.Read(pad)
+
+	return pad, err
+}
+
+// newCipher builds an RC4 stream from HASH(name, S, SKEY), discarding the first 1024 bytes
+func newCipher(name string, secret []byte, skey [20]byte) *rc4.Cipher {
+
+	c, _ := rc4.NewCipher(hash([]byte(name), secret, skey[:]))
+
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+
+	return c
+}
+
+func xor(a, b []byte) []byte {
+
+	out := make([]byte, len(a))
+
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+
+	return out
+}
+
+// synchronize reads r until pattern has been seen, looking at no more than limit bytes before it
+func synchronize(r io.Reader, pattern []byte, limit int) error {
+
+	window := make([]byte, len(pattern))
+
+	if _, err := io.ReadFull(r, window); err != nil {
+		return err
+	}
+
+	one := make([]byte, 1)
+
+	for skipped := 0; !bytes.Equal(window, pattern); skipped++ {
+
+		if skipped >= limit {
+			return errors.New("mse: synchronization pattern not found")
+		}
+
+		if _, err := io.ReadFull(r, one); err != nil {
+			return err
+		}
+
+		copy(window, window[1:])
+		window[len(window)-1] = one[0]
+	}
+
+	return nil
+}
+
+func selectMethod(offered, allowed uint32) (uint32, error) {
+
+	common := offered & allowed
+
+	if common&CryptoRC4 != 0 {
+		return CryptoRC4, nil
+	}
+
+	if common&CryptoPlaintext != 0 {
+		return CryptoPlaintext, nil
+	}
+
+	return 0, ErrNotAllowed
+}
+
+// Initiate runs the outgoing side of the handshake. provide is the set of methods we offer,
+// skey is the info hash of the torrent we want to talk about.
+func Initiate(conn net.Conn, skey [20]byte, provide uint32) (*Conn, error) {
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{}) // Disable the deadline
+
+	private, ya, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. A->B: Ya, PadA
+	if _, err = conn.Write(append(ya, padA...)); err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	yb := make([]byte, keySize)
+
+	if _, err = io.ReadFull(conn, yb); err != nil {
+		return nil, err
+	}
+
+	secret := sharedSecret(yb, private)
+
+	encrypt := newCipher("keyA", secret, skey)
+	decrypt := newCipher("keyB", secret, skey)
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	//          ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	plain := make([]byte, 8+4+2+2)
+
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+
+	encrypted := make([]byte, len(plain))
+	encrypt.XORKeyStream(encrypted, plain)
+
+	request := hash([]byte("req1"), secret)
+	request = append(request, xor(hash([]byte("req2"), skey[:]), hash([]byte("req3"), secret))...)
+	request = append(request, encrypted...)
+
+	if _, err = conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	// B's VC is found by encrypting our own copy of it with B's key stream
+	pattern := make([]byte, len(vc))
+	decrypt.XORKeyStream(pattern, vc)
+
+	if err = synchronize(conn, pattern, maxPadSize); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 4+2)
+
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(reply, reply)
+
+	selected := binary.BigEndian.Uint32(reply[0:4])
+	padLength := int(binary.BigEndian.Uint16(reply[4:6]))
+
+	if padLength > maxPadSize {
+		return nil, fmt.Errorf("mse: padD too long (%d)", padLength)
+	}
+
+	padD := make([]byte, padLength)
+
+	if _, err = io.ReadFull(conn, padD); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(padD, padD)
+
+	switch {
+
+	case selected == CryptoRC4 && provide&CryptoRC4 != 0:
+		return &Conn{Conn: conn, encrypt: encrypt, decrypt: decrypt}, nil
+
+	case selected == CryptoPlaintext && provide&CryptoPlaintext != 0:
+		return &Conn{Conn: conn}, nil
+	}
+
+	return nil, fmt.Errorf("mse: peer selected crypto method %#x which was not offered", selected)
+}
+
+// Accept runs the receiving side of the handshake. skeys are the info hashes we are serving;
+// the one the peer asked for is returned. A plaintext BitTorrent handshake is recognised and
+// passed through untouched when the policy allows it.
+func Accept(conn net.Conn, skeys [][20]byte, policy Policy) (*Conn, [20]byte, error) {
+
+	var skey [20]byte
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{}) // Disable the deadline
+
+	allowed := policy.Provide()
+
+	// The first 20 bytes are either "\x13BitTorrent protocol" or the start of Ya
+	ya := make([]byte, keySize)
+
+	if _, err := io.ReadFull(conn, ya[:20]); err != nil {
+		return nil, skey, err
+	}
+
+	if bytes.Equal(ya[:20], []byte("\x13BitTorrent protocol")) {
+
+		if allowed&CryptoPlaintext == 0 {
+			return nil, skey, errors.New("mse: plaintext connection refused by policy")
+		}
+
+		return &Conn{Conn: conn, pending: ya[:20]}, skey, nil
+	}
+
+	if policy == PolicyDisabled {
+		return nil, skey, errors.New("mse: encrypted connection refused by policy")
+	}
+
+	if _, err := io.ReadFull(conn, ya[20:]); err != nil {
+		return nil, skey, err
+	}
+
+	private, yb, err := newKeyPair()
+	if err != nil {
+		return nil, skey, err
+	}
+
+	padB, err := randomPad()
+	if err != nil {
+		return nil, skey, err
+	}
+
+	// 2. B->A: Yb, PadB
+	if _, err = conn.Write(append(yb, padB...)); err != nil {
+		return nil, skey, err
+	}
+
+	secret := sharedSecret(ya, private)
+
+	// 3. Skip PadA by looking for HASH('req1', S)
+	if err = synchronize(conn, hash([]byte("req1"), secret), maxPadSize); err != nil {
+		return nil, skey, err
+	}
+
+	obfuscated := make([]byte, 20)
+
+	if _, err = io.ReadFull(conn, obfuscated); err != nil {
+		return nil, skey, err
+	}
+
+	req3 := hash([]byte("req3"), secret)
+	found := false
+
+	for _, candidate := range skeys {
+
+		if bytes.Equal(obfuscated, xor(hash([]byte("req2"), candidate[:]), req3)) {
+
+			skey = candidate
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil, skey, errors.New("mse: peer asked for an unknown info hash")
+	}
+
+	decrypt := newCipher("keyA", secret, skey)
+	encrypt := newCipher("keyB", secret, skey)
+
+	header := make([]byte, 8+4+2)
+
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return nil, skey, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	if !bytes.Equal(header[0:8], vc) {
+		return nil, skey, errors.New("mse: bad verification constant")
+	}
+
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLength := int(binary.BigEndian.Uint16(header[12:14]))
+
+	if padLength > maxPadSize {
+		return nil, skey, fmt.Errorf("mse: padC too long (%d)", padLength)
+	}
+
+	// PadC followed by len(IA)
+	rest := make([]byte, padLength+2)
+
+	if _, err = io.ReadFull(conn, rest); err != nil {
+		return nil, skey, err
+	}
+	decrypt.XORKeyStream(rest, rest)
+
+	initialPayload := make([]byte, binary.BigEndian.Uint16(rest[padLength:]))
+
+	if _, err = io.ReadFull(conn, initialPayload); err != nil {
+		return nil, skey, err
+	}
+	decrypt.XORKeyStream(initialPayload, initialPayload)
+
+	selected, err := selectMethod(provide, allowed)
+	if err != nil {
+		return nil, skey, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	reply := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	encrypt.XORKeyStream(reply, reply)
+
+	if _, err = conn.Write(reply); err != nil {
+		return nil, skey, err
+	}
+
+	if selected == CryptoPlaintext {
+		return &Conn{Conn: conn, pending: initialPayload}, skey, nil
+	}
+
+	return &Conn{Conn: conn, pending: initialPayload, encrypt: encrypt, decrypt: decrypt}, skey, nil
+}
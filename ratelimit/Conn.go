@@ -0,0 +1,87 @@
+package ratelimit
+
+import "net"
+
+// Limits holds the download and upload limiters of one level, such as a torrent or a single peer
+type Limits struct {
+	Download *Limiter
+	Upload   *Limiter
+}
+
+// NewLimits creates limiters for the given rates in bytes per second, 0 for no limit
+func NewLimits(download, upload int) *Limits {
+
+	return &Limits{NewLimiter(download), NewLimiter(upload)}
+}
+
+// Global is shared by every connection of the process, unlimited until its rates are set
+var Global = NewLimits(0, 0)
+
+// chunk is the most a single read or write moves before waiting, so that bursts stay small
+const chunk = 16 << 10
+
+// Conn charges everything read from and written to a connection against the limiters of every level,
+// so protocol messages count as much as piece data
+type Conn struct {
+	net.Conn
+
+	download []*Limiter
+	upload   []*Limiter
+}
+
+// NewConn limits conn by every level given. Nil levels are skipped.
+func NewConn(conn net.Conn, levels ...*Limits) *Conn {
+
+	c := &Conn{Conn: conn}
+
+	for _, level := range levels {
+
+		if level == nil {
+			continue
+		}
+
+		c.download = append(c.download, level.Download)
+		c.upload = append(c.upload, level.Upload)
+	}
+
+	return c
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := c.Conn.Read(p)
+
+	// What has been read is charged afterwards, which holds back the next read
+	WaitN(n, c.download...)
+
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+
+	written := 0
+
+	for written < len(p) {
+
+		end := written + chunk
+
+		if end > len(p) {
+			end = len(p)
+		}
+
+		WaitN(end-written, c.upload...)
+
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// minBurst keeps a low rate from splitting every message into many waits
+const minBurst = 16 << 10
+
+// Limiter is a token bucket handing out bytes at a fixed rate. Callers may take more than is available
+// and wait for the debt to be paid off, so a large read or write never needs to be split up.
+type Limiter struct {
+	lock   sync.Mutex
+	rate   int // Bytes per second, 0 for no limit
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter allowing rate bytes per second, 0 for no limit
+func NewLimiter(rate int) *Limiter {
+
+	l := &Limiter{last: time.Now()}
+	l.SetRate(rate)
+
+	return l
+}
+
+// SetRate changes the rate, also while connections use the limiter. The bucket starts out full.
+func (l *Limiter) SetRate(rate int) {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+
+	if rate != l.rate {
+
+		l.rate = rate
+		l.tokens = float64(l.burst())
+		l.last = time.Now()
+	}
+}
+
+func (l *Limiter) Rate() int {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.rate
+}
+
+// burst is how many bytes may go out at once after a quiet period, a quarter second's worth
+func (l *Limiter) burst() int {
+
+	if l.rate/4 < minBurst {
+		return minBurst
+	}
+
+	return l.rate / 4
+}
+
+// reserve takes n bytes and returns how long to wait before using them
+func (l *Limiter) reserve(n int) time.Duration {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	now := time.Now()
+
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	l.last = now
+
+	if l.tokens > float64(l.burst()) {
+		l.tokens = float64(l.burst())
+	}
+
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may be transferred through every given limiter. Nil limiters are skipped.
+func WaitN(n int, limiters ...*Limiter) {
+
+	var wait time.Duration
+
+	for _, l := range limiters {
+
+		if l == nil {
+			continue
+		}
+
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"sync"
+)
+
+// Penalties added to a peer's violation score
+const (
+	// PenaltyProtocolError is charged when a peer is disconnected for a malformed or oversized message
+	PenaltyProtocolError = 25
+
+	// PenaltyUnrequestedBlock is charged for every block we never asked for
+	PenaltyUnrequestedBlock = 5
+
+	// PenaltyCorruptData is charged for every piece a peer sent bad blocks of
+	PenaltyCorruptData = 50
+)
+
+// DefaultBanThreshold is the violation score at which a peer gets banned
+const DefaultBanThreshold = 100
+
+// banList scores misbehaving peers by IP and refuses the ones that went over the threshold
+type banList struct {
+	lock   sync.Mutex
+	scores map[string]int
+	banned map[string]string
+}
+
+func newBanList() *banList {
+
+	return &banList{
+
+		scores: make(map[string]int),
+		banned: make(map[string]string),
+	}
+}
+
+// penalize adds points to a peer's score and reports whether that got it banned. Peers banned
+// before are not reported again.
+func (b *banList) penalize(ip string, points, threshold int, reason string) bool {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.banned[ip]; ok {
+		return false
+	}
+
+	b.scores[ip] += points
+
+	if threshold > 0 && b.scores[ip] >= threshold {
+
+		b.banned[ip] = reason
+		return true
+	}
+
+	return false
+}
+
+func (b *banList) isBanned(ip string) bool {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	_, ok := b.banned[ip]
+
+	return ok
+}
+
+// Banned returns every banned IP with the reason of the violation that got it banned
+func (service *TorrentService) Banned() map[string]string {
+
+	service.bans.lock.Lock()
+	defer service.bans.lock.Unlock()
+
+	banned := make(map[string]string, len(service.bans.banned))
+
+	for ip, reason := range service.bans.banned {
+		banned[ip] = reason
+	}
+
+	return banned
+}
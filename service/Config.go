@@ -0,0 +1,144 @@
+package service
+
+import (
+	"example/bittorrent_in_go/hashing"
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/mse"
+	"example/bittorrent_in_go/ratelimit"
+	"example/bittorrent_in_go/storage"
+	"time"
+)
+
+// DefaultKeepAliveInterval is how long a connection may go without us writing before a keep-alive is sent.
+// Peers usually drop connections that stay quiet for two minutes.
+const DefaultKeepAliveInterval = 90 * time.Second
+
+// DefaultIdleTimeout is how long a peer may stay completely silent before we disconnect it
+const DefaultIdleTimeout = 3 * time.Minute
+
+// DefaultResumeInterval is how often the resume file is updated while downloading
+const DefaultResumeInterval = 30 * time.Second
+
+// DefaultRequestTimeout is how long a block request may stay unanswered before the block is given to another peer
+const DefaultRequestTimeout = 20 * time.Second
+
+type Config struct {
+	KeepAliveInterval time.Duration
+	IdleTimeout       time.Duration
+	RequestTimeout    time.Duration
+
+	// Encryption decides whether connections use Message Stream Encryption, in both directions
+	Encryption mse.Policy
+
+	// PreferUTP dials peers over uTP first and falls back to TCP
+	PreferUTP bool
+
+	// ListenAddress is where peers can connect to us while downloading, over TCP and also uTP when it is
+	// preferred. Empty to only connect out.
+	ListenAddress string
+
+	// MaxMessageLengths overrides the length limit of individual message IDs
+	MaxMessageLengths map[uint8]uint32
+
+	// BanThreshold is the protocol violation score that gets a peer banned, 0 disables banning
+	BanThreshold int
+
+	// Picker chooses which piece each peer downloads next
+	Picker PiecePicker
+
+	// DownloadDir holds the downloaded content and its resume file
+	DownloadDir    string
+	ResumeInterval time.Duration
+
+	// Storage opens where the downloaded pieces are kept, files in DownloadDir when nil
+	Storage storage.Opener
+
+	// Allocation is how the default file storage reserves disk space
+	Allocation storage.Allocation
+
+	// Hasher checks pieces, hashing.Default when nil so that all torrents share the CPUs it may use
+	Hasher *hashing.Pool
+
+	// MaxConnections is how many peers the download keeps connections to, MaxHalfOpen how many
+	// connection attempts may be in progress at once
+	MaxConnections int
+	MaxHalfOpen    int
+
+	// PeerSource finds peers when the download starts or stalls, the tracker when nil
+	PeerSource func() ([]model.Peer, error)
+
+	// StallTimeout is how long the download may go without data before more peers are looked for,
+	// GiveUpTimeout how long before it fails with ErrStalled, 0 to never give up
+	StallTimeout  time.Duration
+	GiveUpTimeout time.Duration
+
+	// RetryBackoff is how long a peer is left alone after it failed or disconnected, doubling with every failure in a row
+	RetryBackoff time.Duration
+
+	// Rate limits of the torrent and of each of its connections in bytes per second, 0 for no limit.
+	// Limits for the whole process are set on ratelimit.Global.
+	DownloadLimit     int
+	UploadLimit       int
+	PeerDownloadLimit int
+	PeerUploadLimit   int
+}
+
+func (c *Config) openStorage(torrent *model.TorrentFile) (storage.Storage, error) {
+
+	if c.Storage != nil {
+		return c.Storage(torrent)
+	}
+
+	return storage.NewFileStorage(torrent, c.DownloadDir, c.Allocation)
+}
+
+func (c *Config) hasher() *hashing.Pool {
+
+	if c.Hasher != nil {
+		return c.Hasher
+	}
+
+	return hashing.Default
+}
+
+// connectionOptions describes how to connect to the peers of a torrent limited by limits
+func (c *Config) connectionOptions(limits *ratelimit.Limits) model.ConnectionOptions {
+
+	limits.Download.SetRate(c.DownloadLimit)
+	limits.Upload.SetRate(c.UploadLimit)
+
+	return model.ConnectionOptions{
+
+		Encryption: c.Encryption,
+		PreferUTP:  c.PreferUTP,
+
+		MaxMessageLengths: c.MaxMessageLengths,
+
+		RateLimits:        []*ratelimit.Limits{ratelimit.Global, limits},
+		PeerDownloadLimit: c.PeerDownloadLimit,
+		PeerUploadLimit:   c.PeerUploadLimit,
+	}
+}
+
+func DefaultConfig() Config {
+
+	return Config{
+
+		KeepAliveInterval: DefaultKeepAliveInterval,
+		IdleTimeout:       DefaultIdleTimeout,
+		RequestTimeout:    DefaultRequestTimeout,
+		Encryption:        mse.PolicyPrefer,
+		PreferUTP:         true,
+		ListenAddress:     DefaultListenAddress,
+		BanThreshold:      DefaultBanThreshold,
+		Picker:            NewRarestFirstPicker(DefaultRandomFirst),
+		DownloadDir:       ".",
+		ResumeInterval:    DefaultResumeInterval,
+		Allocation:        storage.AllocateSparse,
+		MaxConnections:    DefaultMaxConnections,
+		MaxHalfOpen:       DefaultMaxHalfOpen,
+		RetryBackoff:      DefaultRetryBackoff,
+		StallTimeout:      DefaultStallTimeout,
+		GiveUpTimeout:     DefaultGiveUpTimeout,
+	}
+}
@@ -0,0 +1,329 @@
+package service
+
+import (
+	"example/bittorrent_in_go/model"
+	"sync"
+	"time"
+)
+
+// DefaultMaxConnections is how many peers a torrent keeps connections to
+const DefaultMaxConnections = 40
+
+// DefaultMaxHalfOpen is how many connection attempts of a torrent may be in progress at once
+const DefaultMaxHalfOpen = 8
+
+// DefaultRetryBackoff is how long a peer is left alone after a failed attempt or a disconnect. Every
+// further failure in a row doubles it, up to MaxRetryBackoff.
+const DefaultRetryBackoff = 15 * time.Second
+
+const MaxRetryBackoff = 10 * time.Minute
+
+// MaxConnectAttempts is how many attempts in a row may fail before a peer is dropped from the pool
+const MaxConnectAttempts = 6
+
+type candidateState uint8
+
+const (
+	candidateIdle candidateState = iota
+	candidateDialing
+	candidateConnected
+)
+
+// candidate is a peer we know of, connected or not
+type candidate struct {
+	peer     model.Peer
+	state    candidateState
+	failures int
+	retryAt  time.Time
+}
+
+// peerPool holds every peer learned from any source. While a download runs, it keeps dialing them until
+// the torrent has enough connections, and brings back peers that failed or disconnected after a backoff.
+type peerPool struct {
+	lock       sync.Mutex
+	candidates []*candidate
+	byAddress  map[string]*candidate
+
+	halfOpen  int
+	connected int
+
+	// Addresses of peers that connected to us. They take a slot, but their port is not one to dial.
+	incoming map[string]bool
+
+	// Signals that a connection slot may have opened up
+	wake chan struct{}
+}
+
+func newPeerPool() *peerPool {
+
+	return &peerPool{
+
+		byAddress: make(map[string]*candidate),
+		incoming:  make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func (p *peerPool) signal() {
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// AddPeers adds peers to the pool the download connects to, from a tracker or any other source.
+// It returns how many of them were new.
+func (service *TorrentService) AddPeers(peers []model.Peer) int {
+
+	p := service.pool
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	added := 0
+
+	for _, peer := range peers {
+
+		address := peer.String()
+
+		if _, ok := p.byAddress[address]; ok {
+			continue
+		}
+
+		c := &candidate{peer: peer}
+
+		p.candidates = append(p.candidates, c)
+		p.byAddress[address] = c
+
+		added++
+	}
+
+	if added > 0 {
+		p.signal()
+	}
+
+	return added
+}
+
+// connectedTo registers a connection made outside the pool
+func (p *peerPool) connectedTo(peer model.Peer) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c, ok := p.byAddress[peer.String()]
+
+	if !ok {
+
+		c = &candidate{peer: peer}
+
+		p.candidates = append(p.candidates, c)
+		p.byAddress[peer.String()] = c
+	}
+
+	if c.state != candidateConnected {
+
+		c.state = candidateConnected
+		p.connected++
+	}
+}
+
+// acceptedFrom takes a slot for a peer that connected to us, and reports false when there is none left
+func (p *peerPool) acceptedFrom(peer model.Peer, maxConnections int) bool {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.connected+p.halfOpen >= maxConnections {
+		return false
+	}
+
+	p.incoming[peer.String()] = true
+	p.connected++
+
+	return true
+}
+
+// disconnected frees the slot of a peer. Peers we dialed are tried again after the backoff.
+func (p *peerPool) disconnected(peer model.Peer, backoff time.Duration) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.incoming[peer.String()] {
+
+		delete(p.incoming, peer.String())
+		p.connected--
+		p.signal()
+
+		return
+	}
+
+	c, ok := p.byAddress[peer.String()]
+
+	if !ok || c.state != candidateConnected {
+		return
+	}
+
+	p.connected--
+	p.retryLater(c, backoff)
+	p.signal()
+}
+
+// retryLater backs a peer off after a failure, dropping it when it keeps failing. The lock is held.
+func (p *peerPool) retryLater(c *candidate, backoff time.Duration) {
+
+	c.state = candidateIdle
+	c.failures++
+
+	if c.failures >= MaxConnectAttempts {
+
+		p.remove(c)
+		return
+	}
+
+	backoff <<= c.failures - 1
+
+	if backoff > MaxRetryBackoff {
+		backoff = MaxRetryBackoff
+	}
+
+	c.retryAt = time.Now().Add(backoff)
+}
+
+func (p *peerPool) remove(c *candidate) {
+
+	delete(p.byAddress, c.peer.String())
+
+	for i, other := range p.candidates {
+
+		if other == c {
+
+			p.candidates = append(p.candidates[:i], p.candidates[i+1:]...)
+			return
+		}
+	}
+}
+
+// pending tells whether the pool may still come up with a connection
+func (p *peerPool) pending(bans *banList) bool {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.halfOpen > 0 {
+		return true
+	}
+
+	for _, c := range p.candidates {
+
+		if c.state == candidateIdle && !bans.isBanned(c.peer.IP.String()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maintainConnections dials peers from the pool until stop is closed, handing new connections to the download
+func (service *TorrentService) maintainConnections(connected chan<- *model.Client, stop <-chan struct{}) {
+
+	for {
+
+		timer := time.NewTimer(service.dialMore(connected, stop))
+
+		select {
+
+		case <-stop:
+			timer.Stop()
+			return
+
+		case <-service.pool.wake:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+	}
+}
+
+// dialMore starts connection attempts while there are free slots, oldest peers first. It returns when
+// to look again for peers whose backoff is over.
+func (service *TorrentService) dialMore(connected chan<- *model.Client, stop <-chan struct{}) time.Duration {
+
+	p := service.pool
+	now := time.Now()
+	next := time.Second
+
+	maxConnections := service.Config.MaxConnections
+	maxHalfOpen := service.Config.MaxHalfOpen
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, c := range p.candidates {
+
+		if p.halfOpen >= maxHalfOpen || p.connected+p.halfOpen >= maxConnections {
+			break
+		}
+
+		if c.state != candidateIdle || service.bans.isBanned(c.peer.IP.String()) {
+			continue
+		}
+
+		if c.retryAt.After(now) {
+
+			if c.retryAt.Sub(now) < next {
+				next = c.retryAt.Sub(now)
+			}
+
+			continue
+		}
+
+		c.state = candidateDialing
+		p.halfOpen++
+
+		go service.dial(c, connected, stop)
+	}
+
+	return next
+}
+
+func (service *TorrentService) dial(c *candidate, connected chan<- *model.Client, stop <-chan struct{}) {
+
+	ch := make(chan *model.Client, 1)
+
+	model.NewClient(c.peer, service.Torrent.InfoHash, len(service.Torrent.PieceHashes), service.PeerID, service.ConnectionOptions(), ch)
+
+	client := <-ch
+
+	p := service.pool
+
+	p.lock.Lock()
+
+	p.halfOpen--
+
+	if client == nil {
+
+		p.retryLater(c, service.Config.RetryBackoff)
+		p.signal()
+		p.lock.Unlock()
+
+		return
+	}
+
+	c.state = candidateConnected
+	c.failures = 0
+	p.connected++
+
+	p.lock.Unlock()
+
+	select {
+
+	case connected <- client:
+
+	case <-stop:
+		client.Close()
+		p.disconnected(client.Peer, service.Config.RetryBackoff)
+	}
+}
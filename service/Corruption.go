@@ -0,0 +1,112 @@
+package service
+
+import (
+	"crypto/sha1"
+)
+
+// blockRecord is a block of a piece that failed its hash check
+type blockRecord struct {
+	block  int
+	sender string
+	hash   [20]byte
+}
+
+// recordFailure remembers who sent each block of a piece that failed its hash check. A piece that came
+// from a single peer convicts it right away, otherwise the blocks are compared with the good copy later.
+func (s *scheduler) recordFailure(state *pieceProgress) {
+
+	senders := make(map[string]bool)
+	fromDisk := false
+
+	for _, sender := range state.senders {
+
+		if sender == "" {
+			fromDisk = true
+		} else {
+			senders[sender] = true
+		}
+	}
+
+	if len(senders) == 1 && !fromDisk {
+
+		for sender := range senders {
+			s.penalizeIP(sender, PenaltyCorruptData, "sent a piece that failed its hash check")
+		}
+
+		return
+	}
+
+	index := state.work.index
+
+	for block, sender := range state.senders {
+
+		if sender == "" {
+			continue
+		}
+
+		begin := block * MaxBlockSize
+		end := begin + s.blockLength(blockKey{index, begin})
+
+		s.failed[index] = append(s.failed[index], blockRecord{block, sender, sha1.Sum(state.buf[begin:end])})
+	}
+}
+
+// blameCorrupt compares the blocks of earlier failed attempts with a piece that passed its hash check,
+// and penalizes every peer that sent a block that differs
+func (s *scheduler) blameCorrupt(state *pieceProgress) {
+
+	index := state.work.index
+	records, ok := s.failed[index]
+
+	if !ok {
+		return
+	}
+
+	delete(s.failed, index)
+
+	culprits := make(map[string]bool)
+
+	for _, record := range records {
+
+		begin := record.block * MaxBlockSize
+		end := begin + s.blockLength(blockKey{index, begin})
+
+		if sha1.Sum(state.buf[begin:end]) != record.hash {
+			culprits[record.sender] = true
+		}
+	}
+
+	for ip := range culprits {
+		s.penalizeIP(ip, PenaltyCorruptData, "sent corrupt blocks")
+	}
+}
+
+// avoid tells whether the peer sent blocks of a failed attempt at the piece while a peer that did not
+// could download it instead
+func (s *scheduler) avoid(peer *peerSession, index int) bool {
+
+	records, ok := s.failed[index]
+
+	if !ok {
+		return false
+	}
+
+	suspects := make(map[string]bool)
+
+	for _, record := range records {
+		suspects[record.sender] = true
+	}
+
+	if !suspects[peer.client.Peer.IP.String()] {
+		return false
+	}
+
+	for _, other := range s.peers {
+
+		if other.has.HasPiece(index) && !suspects[other.client.Peer.IP.String()] {
+			return true
+		}
+	}
+
+	return false
+}
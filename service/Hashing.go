@@ -0,0 +1,52 @@
+package service
+
+import (
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/storage"
+	"fmt"
+	"sync"
+)
+
+// checkPieces reads pieces from the storage and hash-checks them on the hashing pool, reading ahead while
+// earlier pieces are hashed. checked is called once per piece, never concurrently, in no particular order.
+func (service *TorrentService) checkPieces(store storage.Storage, work []*pieceWork, checked func(index int, ok bool)) error {
+
+	pool := service.Config.hasher()
+	buffers := model.NewBufferPool(service.Torrent.PieceLength)
+
+	// Enough pieces in flight to keep every worker busy without reading the whole torrent into memory
+	inflight := make(chan struct{}, 2*pool.Workers())
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+
+	defer wg.Wait()
+
+	for _, piece := range work {
+
+		inflight <- struct{}{}
+
+		buf := buffers.Get(piece.length)
+
+		if _, err := store.ReadAt(buf, piece.index, 0); err != nil {
+			return fmt.Errorf("reading piece #%d: %w", piece.index, err)
+		}
+
+		wg.Add(1)
+
+		piece := piece
+
+		pool.Submit(buf, func(sum [20]byte) {
+
+			lock.Lock()
+			checked(piece.index, sum == piece.hash)
+			lock.Unlock()
+
+			buffers.Put(buf)
+			<-inflight
+			wg.Done()
+		})
+	}
+
+	return nil
+}
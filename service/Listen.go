@@ -0,0 +1,140 @@
+package service
+
+import (
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/utp"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultListenAddress is where peers can connect to us
+const DefaultListenAddress = ":54788"
+
+// listen accepts peers on Config.ListenAddress over TCP, and over uTP on the same port when uTP is used,
+// until stop is closed. Peers that complete the handshake are handed to the download like dialed ones.
+func (service *TorrentService) listen(connected chan<- *model.Client, stop <-chan struct{}) error {
+
+	tcp, err := net.Listen("tcp", service.Config.ListenAddress)
+
+	if err != nil {
+		return err
+	}
+
+	listeners := []net.Listener{tcp}
+	port := tcp.Addr().(*net.TCPAddr).Port
+
+	if service.Config.PreferUTP {
+
+		host, _, _ := net.SplitHostPort(service.Config.ListenAddress)
+		socket, err := utp.Listen(net.JoinHostPort(host, strconv.Itoa(port)))
+
+		if err == nil {
+			listeners = append(listeners, socket)
+		} else {
+			fmt.Printf("Not accepting uTP connections: %v\n", err)
+		}
+	}
+
+	atomic.StoreInt32(&service.listenPort, int32(port))
+
+	for _, listener := range listeners {
+		go service.acceptPeers(listener, connected, stop)
+	}
+
+	go func() {
+
+		<-stop
+
+		atomic.StoreInt32(&service.listenPort, 0)
+
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	return nil
+}
+
+// ListenPort returns the port peers can connect to while the download runs, 0 when it does not accept peers
+func (service *TorrentService) ListenPort() int {
+
+	return int(atomic.LoadInt32(&service.listenPort))
+}
+
+// announcePort is the port the tracker tells other peers to connect to
+func (service *TorrentService) announcePort() uint16 {
+
+	if port := service.ListenPort(); port != 0 {
+		return uint16(port)
+	}
+
+	address := service.Config.ListenAddress
+
+	if address == "" {
+		address = DefaultListenAddress
+	}
+
+	_, port, _ := net.SplitHostPort(address)
+	number, err := strconv.Atoi(port)
+
+	if err != nil || number == 0 {
+
+		_, port, _ = net.SplitHostPort(DefaultListenAddress)
+		number, _ = strconv.Atoi(port)
+	}
+
+	return uint16(number)
+}
+
+func (service *TorrentService) acceptPeers(listener net.Listener, connected chan<- *model.Client, stop <-chan struct{}) {
+
+	for {
+
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go service.accept(conn, connected, stop)
+	}
+}
+
+// accept runs the handshake with a peer that connected to us, unless it is banned or all slots are taken
+func (service *TorrentService) accept(conn net.Conn, connected chan<- *model.Client, stop <-chan struct{}) {
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if service.bans.isBanned(host) {
+
+		conn.Close()
+		return
+	}
+
+	client, err := model.AcceptClient(conn, service.Torrent.InfoHash, len(service.Torrent.PieceHashes), service.PeerID, service.ConnectionOptions())
+
+	if err != nil {
+
+		fmt.Printf("Incoming connection from %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+
+		return
+	}
+
+	if !service.pool.acceptedFrom(client.Peer, service.Config.MaxConnections) {
+
+		client.Close()
+		return
+	}
+
+	select {
+
+	case connected <- client:
+
+	case <-stop:
+		client.Close()
+		service.pool.disconnected(client.Peer, service.Config.RetryBackoff)
+	}
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"example/bittorrent_in_go/model"
+	"math/rand"
+	"time"
+)
+
+// DefaultRandomFirst is the number of pieces picked at random before switching to rarest-first.
+// A few random pieces complete faster than rare ones and give us something to trade early.
+const DefaultRandomFirst = 4
+
+// PickContext is everything a picker may base its decision on
+type PickContext struct {
+	// Pieces the peer has that we still need and nobody else is downloading
+	Candidates model.Bitfield
+
+	// Number of connected peers that have each piece
+	Availability []int
+
+	// Number of pieces we have already verified
+	Completed int
+}
+
+// PiecePicker decides which piece a peer downloads next
+type PiecePicker interface {
+	// Pick returns one of ctx.Candidates, or -1 when there is none
+	Pick(ctx *PickContext) int
+}
+
+// RarestFirstPicker picks the piece the fewest peers have, breaking ties randomly.
+// The first RandomFirst pieces are chosen uniformly at random instead.
+type RarestFirstPicker struct {
+	RandomFirst int
+
+	random *rand.Rand
+}
+
+func NewRarestFirstPicker(randomFirst int) *RarestFirstPicker {
+
+	return &RarestFirstPicker{
+
+		RandomFirst: randomFirst,
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (p *RarestFirstPicker) Pick(ctx *PickContext) int {
+
+	if ctx.Completed < p.RandomFirst {
+		return p.pickRandom(ctx.Candidates)
+	}
+
+	best := -1
+	rarest := 0
+	ties := 0
+
+	ctx.Candidates.ForEach(func(index int) {
+
+		available := ctx.Availability[index]
+
+		switch {
+
+		case best == -1 || available < rarest:
+			best, rarest, ties = index, available, 1
+
+		case available == rarest:
+			// Reservoir sampling: every tied piece ends up chosen with the same probability
+			ties++
+
+			if p.random.Intn(ties) == 0 {
+				best = index
+			}
+		}
+	})
+
+	return best
+}
+
+func (p *RarestFirstPicker) pickRandom(candidates model.Bitfield) int {
+
+	count := candidates.Count()
+
+	if count == 0 {
+		return -1
+	}
+
+	target := p.random.Intn(count)
+	picked := -1
+
+	candidates.ForEach(func(index int) {
+
+		if target == 0 {
+			picked = index
+		}
+
+		target--
+	})
+
+	return picked
+}
+
+// SequentialPicker downloads pieces in index order, e.g. for streaming
+type SequentialPicker struct{}
+
+func (SequentialPicker) Pick(ctx *PickContext) int {
+
+	return ctx.Candidates.First()
+}
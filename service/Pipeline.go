@@ -0,0 +1,227 @@
+package service
+
+import (
+	"example/bittorrent_in_go/model"
+	"math"
+	"time"
+)
+
+// InitialBacklog is the number of requests a peer gets before we have measured anything
+const InitialBacklog = 5
+
+// MinBacklog and MaxBacklog bound the adaptive number of unfulfilled requests per peer. A full backlog
+// fits in the peer's outbox with room to spare for other messages.
+const MinBacklog = 2
+const MaxBacklog = model.OutboxSize / 2
+
+// BacklogQueueTime is how much transfer time worth of requests we keep queued at a peer
+// on top of its round-trip time, so it never runs dry while our next requests travel
+const BacklogQueueTime = time.Second
+
+// Weight of the newest sample in the moving averages
+const smoothing = 0.25
+
+type blockKey struct {
+	index int
+	begin int
+}
+
+// pipeline sizes a peer's request queue from its measured throughput and round-trip time
+type pipeline struct {
+	depth    int
+	maxDepth int
+
+	// Smoothed request latency, and the lowest one seen. Latency includes the time a request
+	// waits behind the others queued at the peer, so only the minimum approximates the real RTT.
+	rtt    time.Duration
+	minRTT time.Duration
+	rate   float64 // Bytes per second
+
+	// Send time of every unfulfilled request
+	requests map[blockKey]time.Time
+
+	// Requests the peer dropped by choking us, with the time they were dropped. Blocks for
+	// them may still be on the wire and are not held against the peer for a while.
+	stale map[blockKey]time.Time
+
+	downloaded  int64
+	windowBytes int
+	windowStart time.Time
+}
+
+func newPipeline(reqq int) *pipeline {
+
+	maxDepth := MaxBacklog
+
+	// Never queue more than the peer said it is willing to hold
+	if reqq > 0 && reqq < maxDepth {
+		maxDepth = reqq
+	}
+
+	depth := InitialBacklog
+	if depth > maxDepth {
+		depth = maxDepth
+	}
+
+	return &pipeline{
+
+		depth:       depth,
+		maxDepth:    maxDepth,
+		requests:    make(map[blockKey]time.Time),
+		stale:       make(map[blockKey]time.Time),
+		windowStart: time.Now(),
+	}
+}
+
+func (p *pipeline) setReqq(reqq int) {
+
+	if reqq <= 0 {
+		return
+	}
+
+	p.maxDepth = reqq
+	if p.maxDepth > MaxBacklog {
+		p.maxDepth = MaxBacklog
+	}
+
+	if p.depth > p.maxDepth {
+		p.depth = p.maxDepth
+	}
+}
+
+func (p *pipeline) requested(index, begin int) {
+
+	p.requests[blockKey{index, begin}] = time.Now()
+}
+
+type blockStatus int
+
+const (
+	blockRequested blockStatus = iota
+	blockStale
+	blockUnrequested
+)
+
+// staleGrace is how long blocks for dropped requests are tolerated
+const staleGrace = 30 * time.Second
+
+// received records a block and reports whether we had actually asked for it
+func (p *pipeline) received(index, begin, length int) blockStatus {
+
+	key := blockKey{index, begin}
+
+	sentAt, ok := p.requests[key]
+
+	if !ok {
+
+		if _, ok = p.stale[key]; ok {
+
+			delete(p.stale, key)
+			return blockStale
+		}
+
+		return blockUnrequested
+	}
+
+	delete(p.requests, key)
+
+	sample := time.Since(sentAt)
+
+	if p.rtt == 0 {
+		p.rtt = sample
+	} else {
+		p.rtt += time.Duration(smoothing * float64(sample-p.rtt))
+	}
+
+	if p.minRTT == 0 || sample < p.minRTT {
+		p.minRTT = sample
+	}
+
+	p.downloaded += int64(length)
+	p.windowBytes += length
+
+	return blockRequested
+}
+
+// forget drops all outstanding requests, e.g. after the peer choked us
+func (p *pipeline) forget() {
+
+	now := time.Now()
+
+	for key := range p.requests {
+		p.stale[key] = now
+	}
+
+	p.requests = make(map[blockKey]time.Time)
+}
+
+// timedOut gives up on a request the peer left unanswered and stops queueing much at the peer
+func (p *pipeline) timedOut(key blockKey) {
+
+	if _, ok := p.requests[key]; !ok {
+		return
+	}
+
+	delete(p.requests, key)
+	p.stale[key] = time.Now()
+
+	p.depth = MinBacklog
+}
+
+func (p *pipeline) backlog() int {
+
+	return len(p.requests)
+}
+
+// update folds the bytes received since the last call into the rate and resizes the queue
+func (p *pipeline) update(now time.Time) {
+
+	elapsed := now.Sub(p.windowStart).Seconds()
+
+	if elapsed <= 0 {
+		return
+	}
+
+	for key, droppedAt := range p.stale {
+
+		if now.Sub(droppedAt) > staleGrace {
+			delete(p.stale, key)
+		}
+	}
+
+	sample := float64(p.windowBytes) / elapsed
+
+	p.rate += smoothing * (sample - p.rate)
+	p.windowBytes = 0
+	p.windowStart = now
+
+	// Nothing measured yet, keep the current depth
+	if p.minRTT == 0 || p.rate == 0 {
+		return
+	}
+
+	p.depth = BacklogDepth(p.rate, p.minRTT, p.maxDepth)
+}
+
+// BacklogDepth is how many requests to keep queued at a peer sending rate bytes per second with the given
+// round-trip time: the bandwidth-delay product plus BacklogQueueTime worth of blocks, at least MinBacklog
+// and at most the queue size the peer advertised (reqq) or MaxBacklog
+func BacklogDepth(rate float64, rtt time.Duration, reqq int) int {
+
+	queued := rate * (rtt + BacklogQueueTime).Seconds()
+	depth := int(math.Ceil(queued / MaxBlockSize))
+
+	if depth < MinBacklog {
+		depth = MinBacklog
+	}
+
+	if reqq > 0 && depth > reqq {
+		depth = reqq
+	}
+
+	if depth > MaxBacklog {
+		depth = MaxBacklog
+	}
+
+	return depth
+}
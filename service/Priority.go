@@ -0,0 +1,179 @@
+package service
+
+import (
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/storage"
+	"fmt"
+)
+
+// FilePriority decides whether and how early the pieces of a file are downloaded
+type FilePriority int
+
+const (
+	PrioritySkip FilePriority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p FilePriority) String() string {
+
+	switch p {
+
+	case PrioritySkip:
+		return "skip"
+
+	case PriorityLow:
+		return "low"
+
+	case PriorityNormal:
+		return "normal"
+
+	case PriorityHigh:
+		return "high"
+	}
+
+	return fmt.Sprintf("FilePriority(%d)", int(p))
+}
+
+// SetFilePriority changes the priority of a file of the torrent, also while downloading.
+// Skipped files are not created on disk unless they already exist.
+func (service *TorrentService) SetFilePriority(file int, priority FilePriority) error {
+
+	service.priorityLock.Lock()
+	defer service.priorityLock.Unlock()
+
+	if file < 0 || file >= len(service.filePriorities) {
+		return fmt.Errorf("no file #%d in torrent", file)
+	}
+
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+
+	service.filePriorities[file] = priority
+	service.priorityVersion++
+
+	service.progress.lock.Lock()
+	store := service.progress.store
+	service.progress.lock.Unlock()
+
+	if skipper, ok := store.(storage.Skipper); ok {
+		return skipper.SetSkipped(file, priority == PrioritySkip)
+	}
+
+	return nil
+}
+
+// FilePriorities returns the priority of every file of the torrent
+func (service *TorrentService) FilePriorities() []FilePriority {
+
+	service.priorityLock.Lock()
+	defer service.priorityLock.Unlock()
+
+	return append([]FilePriority(nil), service.filePriorities...)
+}
+
+// applySkipped tells a newly opened storage which files to leave out
+func (service *TorrentService) applySkipped(store storage.Storage) error {
+
+	service.priorityLock.Lock()
+	defer service.priorityLock.Unlock()
+
+	skipper, ok := store.(storage.Skipper)
+
+	if !ok {
+		return nil
+	}
+
+	for file, priority := range service.filePriorities {
+
+		if err := skipper.SetSkipped(file, priority == PrioritySkip); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// piecePriorities gives every piece the highest priority of the files it holds data of. It returns
+// nil if nothing changed since the given version.
+func (service *TorrentService) piecePriorities(version int) ([]FilePriority, int) {
+
+	service.priorityLock.Lock()
+	defer service.priorityLock.Unlock()
+
+	if version == service.priorityVersion {
+		return nil, version
+	}
+
+	priorities := make([]FilePriority, service.Torrent.NumPieces())
+
+	for file, priority := range service.filePriorities {
+
+		first, last := service.Torrent.FilePieces(file)
+
+		for index := first; index <= last; index++ {
+
+			if priority > priorities[index] {
+				priorities[index] = priority
+			}
+		}
+	}
+
+	return priorities, service.priorityVersion
+}
+
+// updatePriorities picks up changed file priorities
+func (s *scheduler) updatePriorities() {
+
+	priorities, version := s.service.piecePriorities(s.priorityVersion)
+
+	if priorities == nil {
+		return
+	}
+
+	s.priorities = priorities
+	s.priorityVersion = version
+
+	s.selected = model.NewBitfield(len(s.work))
+
+	for index, priority := range priorities {
+
+		if priority != PrioritySkip {
+			s.selected.MarkPiece(index)
+		}
+	}
+}
+
+// remaining is the number of selected pieces we do not have yet
+func (s *scheduler) remaining() int {
+
+	missing := s.selected.AndNot(s.have)
+
+	return missing.Count()
+}
+
+// topPriority narrows candidates down to the ones of the highest priority among them
+func (s *scheduler) topPriority(candidates model.Bitfield) model.Bitfield {
+
+	top := PrioritySkip
+
+	candidates.ForEach(func(index int) {
+
+		if s.priorities[index] > top {
+			top = s.priorities[index]
+		}
+	})
+
+	narrowed := model.NewBitfield(len(s.work))
+
+	candidates.ForEach(func(index int) {
+
+		if s.priorities[index] == top {
+			narrowed.MarkPiece(index)
+		}
+	})
+
+	return narrowed
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/storage"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// resumeData is what we know about the data on disk when the download stops
+type resumeData struct {
+	InfoHash string `json:"info_hash"`
+	Pieces   []byte `json:"pieces"`
+
+	// Blocks already written for pieces that are not complete yet, by piece index
+	Partial map[int][]int `json:"partial,omitempty"`
+
+	// The content files as they were right after saving. The resume data is only
+	// trusted while they are unchanged.
+	Files []fileStat `json:"files"`
+
+	// Pieces checked against the torrent's piece count once loaded
+	complete model.Bitfield
+}
+
+type fileStat struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+func (service *TorrentService) resumePath() string {
+
+	return filepath.Join(service.Config.DownloadDir, service.Torrent.Name+".resume")
+}
+
+// contentFiles lists the files the torrent's content lives in, leaving out padding files and symlinks
+func (service *TorrentService) contentFiles() []string {
+
+	var paths []string
+
+	for _, file := range service.Torrent.ContentFiles() {
+
+		if file.OnDisk() {
+			paths = append(paths, filepath.Join(service.Config.DownloadDir, file.Path))
+		}
+	}
+
+	return paths
+}
+
+// statFiles records the size and modification time of the content files, missing files are left out
+func (service *TorrentService) statFiles() []fileStat {
+
+	var stats []fileStat
+
+	for _, path := range service.contentFiles() {
+
+		info, err := os.Stat(path)
+
+		if err != nil {
+			continue
+		}
+
+		stats = append(stats, fileStat{path, info.Size(), info.ModTime().UnixNano()})
+	}
+
+	return stats
+}
+
+func sameFiles(a, b []fileStat) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (service *TorrentService) loadResume() (*resumeData, error) {
+
+	buf, err := os.ReadFile(service.resumePath())
+
+	if err != nil {
+		return nil, err
+	}
+
+	resume := new(resumeData)
+
+	if err = json.Unmarshal(buf, resume); err != nil {
+		return nil, err
+	}
+
+	if resume.InfoHash != hex.EncodeToString(service.Torrent.InfoHash[:]) {
+		return nil, fmt.Errorf("resume data belongs to another torrent")
+	}
+
+	if resume.complete, err = model.ParseBitfield(resume.Pieces, service.Torrent.NumPieces()); err != nil {
+		return nil, fmt.Errorf("resume data has a bad piece bitfield")
+	}
+
+	return resume, nil
+}
+
+// saveResume flushes the storage and records its state. Blocks of unfinished pieces are written out first.
+func (service *TorrentService) saveResume(store storage.Storage, scheduler *scheduler) error {
+
+	// Without room for the partial blocks the verified pieces are still worth recording
+	partial, err := scheduler.savePartial(store)
+
+	if err != nil {
+		partial = nil
+	}
+
+	if err = store.Flush(); err != nil {
+		return err
+	}
+
+	completion := store.Completion()
+
+	buf, err := json.Marshal(&resumeData{
+
+		InfoHash: hex.EncodeToString(service.Torrent.InfoHash[:]),
+		Pieces:   completion.Bytes(),
+		Partial:  partial,
+		Files:    service.statFiles(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Replace the old resume file in one step so a crash never leaves half of it behind
+	tmp := service.resumePath() + ".tmp"
+
+	if err = os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, service.resumePath())
+}
+
+// restore marks the pieces and blocks already on disk. The resume data is trusted while the files are
+// unchanged since it was saved, otherwise existing files are checked piece by piece.
+func (service *TorrentService) restore(store storage.Storage, scheduler *scheduler, existing []fileStat) error {
+
+	resume, err := service.loadResume()
+
+	if err == nil && len(existing) > 0 && sameFiles(resume.Files, existing) {
+
+		resume.complete.ForEach(func(index int) {
+
+			if index < len(scheduler.work) {
+				store.MarkComplete(index)
+			}
+		})
+
+		scheduler.restore(store.Completion())
+
+		return scheduler.restorePartial(store, resume.Partial)
+	}
+
+	// Nothing to check in files we have just created
+	if len(existing) == 0 {
+		return nil
+	}
+
+	fmt.Printf("Checking existing data of %s...\n", service.Torrent.Name)
+
+	if err = service.recheck(store, scheduler.work); err != nil {
+		return err
+	}
+
+	scheduler.restore(store.Completion())
+
+	return nil
+}
+
+// recheck hashes every piece in the storage and marks the valid ones complete
+func (service *TorrentService) recheck(store storage.Storage, work []*pieceWork) error {
+
+	return service.checkPieces(store, work, func(index int, ok bool) {
+
+		if ok {
+			store.MarkComplete(index)
+		}
+	})
+}
+
+// restore skips pieces that are already complete
+func (s *scheduler) restore(complete model.Bitfield) {
+
+	complete.ForEach(func(index int) {
+
+		if s.wanted.HasPiece(index) {
+
+			s.wanted.ClearPiece(index)
+			s.have.MarkPiece(index)
+			s.completed++
+		}
+	})
+}
+
+// restorePartial reads the blocks saved for unfinished pieces back into new piece buffers
+func (s *scheduler) restorePartial(store storage.Storage, partial map[int][]int) error {
+
+	for index, blocks := range partial {
+
+		if !s.wanted.HasPiece(index) {
+			continue
+		}
+
+		s.wanted.ClearPiece(index)
+		state := s.newPiece(index)
+
+		for _, block := range blocks {
+
+			if block < 0 || block >= len(state.owners) || state.done.HasPiece(block) {
+				continue
+			}
+
+			key := blockKey{index, block * MaxBlockSize}
+			length := s.blockLength(key)
+
+			if _, err := store.ReadAt(state.buf[key.begin:key.begin+length], index, key.begin); err != nil {
+				return err
+			}
+
+			state.done.MarkPiece(block)
+			state.claimed++
+			state.downloaded += length
+		}
+	}
+
+	return nil
+}
+
+// savePartial writes the blocks of unfinished pieces to the storage and lists them
+func (s *scheduler) savePartial(store storage.Storage) (map[int][]int, error) {
+
+	partial := make(map[int][]int)
+
+	for _, state := range s.active {
+
+		var blocks []int
+
+		for block := range state.owners {
+
+			if !state.done.HasPiece(block) {
+				continue
+			}
+
+			key := blockKey{state.work.index, block * MaxBlockSize}
+			length := s.blockLength(key)
+
+			if _, err := store.WriteAt(state.buf[key.begin:key.begin+length], key.index, key.begin); err != nil {
+				return nil, err
+			}
+
+			blocks = append(blocks, block)
+		}
+
+		if len(blocks) > 0 {
+			partial[state.work.index] = blocks
+		}
+	}
+
+	return partial, nil
+}
@@ -0,0 +1,668 @@
+package service
+
+import (
+	"errors"
+	"example/bittorrent_in_go/model"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scheduler owns all download state and reacts to peer events from a single goroutine.
+// Pieces are split into blocks, and the blocks of one piece may come from several peers.
+type scheduler struct {
+	service *TorrentService
+	work    []*pieceWork
+	peers   map[*model.Client]*peerSession
+
+	// Pieces we still need that nobody has started
+	wanted model.Bitfield
+
+	// Pieces being downloaded, oldest first. Any peer having one may fetch its missing blocks.
+	active []*pieceProgress
+
+	// Verified pieces, and the ones the file priorities ask for
+	have     model.Bitfield
+	selected model.Bitfield
+
+	priorities      []FilePriority
+	priorityVersion int
+
+	// Number of connected peers having each piece
+	availability []int
+	completed    int
+
+	// Piece buffers, handed back once a piece is written or abandoned
+	pieces *model.BufferPool
+
+	// Pieces come back here from the hashing pool, until stopped is closed
+	hashed  chan hashedPiece
+	stopped chan struct{}
+	hashing int
+
+	// Hashed pieces waiting to be sent on hashed. The pool's workers only ever queue them here, so a
+	// download that is slow to take its pieces never holds up the hashing of other torrents.
+	hashLock  sync.Mutex
+	hashQueue []hashedPiece
+	hashReady chan struct{}
+
+	// Blocks of pieces that failed their hash check, kept until a good copy shows who sent bad data
+	failed map[int][]blockRecord
+
+	// When the last block arrived
+	progressAt time.Time
+}
+
+// hashedPiece is a piece whose blocks have all arrived, with the outcome of its hash check
+type hashedPiece struct {
+	state *pieceProgress
+	ok    bool
+}
+
+type peerSession struct {
+	client   *model.Client
+	pipeline *pipeline
+
+	// What the peer has, as already counted in the availability
+	has model.Bitfield
+
+	// Blocks requested from the peer. Each has a reservation the reader decodes straight into
+	// the piece buffer, and stays assigned while the reader may still be writing it.
+	assigned map[blockKey]*pieceProgress
+
+	// Whether the peer asked us for blocks, which we never serve
+	requested bool
+}
+
+// newScheduler takes the work for every piece of the torrent, indexed by piece
+func newScheduler(service *TorrentService, work []*pieceWork) *scheduler {
+
+	s := &scheduler{
+
+		service:      service,
+		work:         work,
+		peers:        make(map[*model.Client]*peerSession),
+		wanted:       model.NewBitfield(len(work)),
+		have:         model.NewBitfield(len(work)),
+		availability: make([]int, len(work)),
+		pieces:       model.NewBufferPool(service.Torrent.PieceLength),
+		hashed:       make(chan hashedPiece),
+		stopped:      make(chan struct{}),
+		hashReady:    make(chan struct{}, 1),
+		failed:       make(map[int][]blockRecord),
+
+		priorityVersion: -1,
+	}
+
+	s.wanted.SetRange(0, len(work))
+	s.updatePriorities()
+
+	go s.forwardHashed()
+
+	return s
+}
+
+func (s *scheduler) addPeer(client *model.Client) {
+
+	s.peers[client] = &peerSession{
+
+		client:   client,
+		pipeline: newPipeline(client.Reqq()),
+		assigned: make(map[blockKey]*pieceProgress),
+		has:      model.NewBitfield(len(s.work)),
+	}
+
+	// Peers stay choked, we do not upload
+	client.SendInterested()
+}
+
+// handle applies an event
+func (s *scheduler) handle(event model.Event) {
+
+	peer, ok := s.peers[event.Client]
+
+	if !ok {
+		return
+	}
+
+	switch event.Type {
+
+	case model.EventChoked:
+		// A choking peer discards every request it has not served yet
+		s.release(peer, false)
+		s.fillAll()
+
+	case model.EventUnchoked:
+		s.fill(peer)
+
+	case model.EventHave:
+		if !peer.has.HasPiece(event.Index) {
+
+			peer.has.MarkPiece(event.Index)
+			s.availability[event.Index]++
+		}
+
+		s.fill(peer)
+
+	case model.EventBitfield:
+		s.updateAvailability(peer.has, -1)
+		peer.has = peer.client.Bitfield()
+		s.updateAvailability(peer.has, 1)
+
+		s.fill(peer)
+
+	case model.EventPiece:
+		s.receiveBlock(peer, event)
+
+	case model.EventRequest:
+		// Like any choking peer we drop the requests. The peer learns nothing is coming from being choked.
+		if !peer.requested {
+
+			fmt.Printf("\nIgnoring requests from %s, we do not upload.\n", peer.client.Peer.String())
+			peer.requested = true
+		}
+
+	case model.EventCancel:
+		// Nothing is queued for the peer, so there is nothing to cancel
+
+	case model.EventDisconnected:
+		s.release(peer, true)
+		s.updateAvailability(peer.has, -1)
+		delete(s.peers, event.Client)
+
+		fmt.Printf("\nDropping %s: %v\n", peer.client.Peer.String(), event.Err)
+
+		var violation *model.ProtocolError
+
+		if errors.As(event.Err, &violation) {
+			s.penalize(peer, PenaltyProtocolError, violation.Reason)
+		}
+
+		s.fillAll()
+	}
+}
+
+func (s *scheduler) updateAvailability(has model.Bitfield, delta int) {
+
+	has.ForEach(func(index int) {
+
+		if index < len(s.availability) {
+			s.availability[index] += delta
+		}
+	})
+}
+
+// tick updates throughput measurements, reassigns timed out blocks and lets peers whose queue grew request more
+func (s *scheduler) tick(now time.Time) {
+
+	s.updatePriorities()
+
+	for _, peer := range s.peers {
+
+		peer.pipeline.setReqq(peer.client.Reqq())
+		peer.pipeline.update(now)
+
+		s.expire(peer, now)
+	}
+
+	s.fillAll()
+
+	s.service.setPeerStats(s.stats())
+}
+
+// expire cancels requests the peer left unanswered for too long so other peers can fetch the blocks
+func (s *scheduler) expire(peer *peerSession, now time.Time) {
+
+	urgent := s.service.progress.urgent()
+
+	for key, sentAt := range peer.pipeline.requests {
+
+		timeout := s.service.Config.RequestTimeout
+
+		// A reader is already waiting for this piece
+		if deadline, ok := urgent[key.index]; ok && now.After(deadline) && timeout > UrgentRequestTimeout {
+			timeout = UrgentRequestTimeout
+		}
+
+		if now.Sub(sentAt) < timeout {
+			continue
+		}
+
+		state := peer.assigned[key]
+
+		// A block the reader is already decoding is about to arrive
+		if state == nil || !s.unassign(peer, key) {
+			continue
+		}
+
+		peer.pipeline.timedOut(key)
+		peer.client.SendCancel(key.index, key.begin, s.blockLength(key))
+	}
+}
+
+// release frees the blocks assigned to a peer that choked us or went away
+func (s *scheduler) release(peer *peerSession, disconnected bool) {
+
+	peer.pipeline.forget()
+
+	for key := range peer.assigned {
+
+		// Once the reader has stopped nothing writes into the piece buffers anymore
+		if !s.unassign(peer, key) && disconnected {
+			s.unassignBlock(peer, key)
+		}
+	}
+}
+
+// unassign withdraws a block's reservation, unless the reader already started filling it
+func (s *scheduler) unassign(peer *peerSession, key blockKey) bool {
+
+	if !peer.client.Unexpect(key.index, key.begin) {
+		return false
+	}
+
+	s.unassignBlock(peer, key)
+
+	return true
+}
+
+// unassignBlock makes a block available to other peers again
+func (s *scheduler) unassignBlock(peer *peerSession, key blockKey) {
+
+	state := peer.assigned[key]
+
+	delete(peer.assigned, key)
+	state.reserved--
+
+	if state.orphaned {
+
+		s.recycle(state)
+		return
+	}
+
+	state.owners[key.begin/MaxBlockSize] = nil
+	state.claimed--
+}
+
+// recycle returns a piece buffer to the pool as soon as no reader can write into it anymore
+func (s *scheduler) recycle(state *pieceProgress) {
+
+	if state.reserved > 0 {
+
+		state.orphaned = true
+		return
+	}
+
+	s.pieces.Put(state.buf)
+	state.buf = nil
+}
+
+func (s *scheduler) blockLength(key blockKey) int {
+
+	return s.service.Torrent.BlockSize(key.index, key.begin/MaxBlockSize)
+}
+
+// start lets the picker choose a new piece among the selected ones the peer has, highest priority first
+func (s *scheduler) start(peer *peerSession) *pieceProgress {
+
+	candidates := peer.has.And(s.wanted)
+	candidates = candidates.And(s.selected)
+
+	for index := range s.failed {
+
+		if s.avoid(peer, index) {
+			candidates.ClearPiece(index)
+		}
+	}
+
+	if candidates.Count() == 0 {
+		return nil
+	}
+
+	candidates = s.topPriority(candidates)
+
+	index := s.service.Config.Picker.Pick(&PickContext{
+
+		Candidates:   candidates,
+		Availability: s.availability,
+		Completed:    s.completed,
+	})
+
+	if !candidates.HasPiece(index) {
+		return nil
+	}
+
+	s.wanted.ClearPiece(index)
+
+	return s.newPiece(index)
+}
+
+// newPiece starts downloading a piece that has been taken off the wanted pieces
+func (s *scheduler) newPiece(index int) *pieceProgress {
+
+	work := s.work[index]
+	blocks := s.service.Torrent.BlockCount(index)
+
+	state := &pieceProgress{
+
+		work:         work,
+		buf:          s.pieces.Get(work.length),
+		owners:       make([]*peerSession, blocks),
+		senders:      make([]string, blocks),
+		done:         model.NewBitfield(blocks),
+		contributors: make(map[string]int),
+	}
+
+	s.active = append(s.active, state)
+
+	return state
+}
+
+// nextBlock finds a block for the peer. Pieces readers wait for come first, then started pieces are
+// finished before new ones are started.
+func (s *scheduler) nextBlock(peer *peerSession) (*pieceProgress, int) {
+
+	for _, index := range s.urgentPieces(s.service.progress.urgent()) {
+
+		if !peer.has.HasPiece(index) || s.avoid(peer, index) {
+			continue
+		}
+
+		if s.wanted.HasPiece(index) {
+
+			s.wanted.ClearPiece(index)
+			return s.newPiece(index), 0
+		}
+
+		if begin, ok := missingBlock(s.activePiece(index)); ok {
+			return s.activePiece(index), begin
+		}
+	}
+
+	for _, state := range s.active {
+
+		if !peer.has.HasPiece(state.work.index) || s.avoid(peer, state.work.index) {
+			continue
+		}
+
+		if begin, ok := missingBlock(state); ok {
+			return state, begin
+		}
+	}
+
+	return s.start(peer), 0
+}
+
+// missingBlock finds a block of the piece that is neither assigned nor done
+func missingBlock(state *pieceProgress) (int, bool) {
+
+	if state.claimed == len(state.owners) {
+		return 0, false
+	}
+
+	for block, owner := range state.owners {
+
+		if owner == nil && !state.done.HasPiece(block) {
+			return block * MaxBlockSize, true
+		}
+	}
+
+	return 0, false
+}
+
+// fill sends requests until the peer's pipeline is full
+func (s *scheduler) fill(peer *peerSession) {
+
+	if peer.client.Choked() {
+		return
+	}
+
+	for peer.pipeline.backlog() < peer.pipeline.depth {
+
+		state, begin := s.nextBlock(peer)
+
+		if state == nil {
+			return
+		}
+
+		key := blockKey{state.work.index, begin}
+		length := s.blockLength(key)
+
+		peer.client.Expect(key.index, key.begin, state.buf[begin:begin+length])
+
+		if peer.client.SendRequest(key.index, key.begin, length) != nil {
+
+			peer.client.Unexpect(key.index, key.begin)
+			return
+		}
+
+		peer.assigned[key] = state
+		state.reserved++
+		state.owners[begin/MaxBlockSize] = peer
+		state.claimed++
+
+		peer.pipeline.requested(key.index, key.begin)
+	}
+}
+
+// fillAll tops up every peer, fastest first so they get the blocks others gave up
+func (s *scheduler) fillAll() {
+
+	peers := make([]*peerSession, 0, len(s.peers))
+
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].pipeline.rate > peers[j].pipeline.rate })
+
+	for _, peer := range peers {
+		s.fill(peer)
+	}
+}
+
+func (s *scheduler) receiveBlock(peer *peerSession, event model.Event) {
+
+	key := blockKey{event.Index, event.Begin}
+	status := peer.pipeline.received(event.Index, event.Begin, len(event.Data))
+
+	if !event.Reserved {
+		defer model.BlockPool.Put(event.Data)
+	}
+
+	state, ok := peer.assigned[key]
+
+	// Blocks we never asked for are penalized, blocks we gave up on are dropped
+	if !ok {
+
+		if status == blockUnrequested {
+			s.penalize(peer, PenaltyUnrequestedBlock, "unrequested block")
+		}
+
+		return
+	}
+
+	if event.Reserved {
+
+		// Already decoded into the piece buffer
+		delete(peer.assigned, key)
+		state.reserved--
+
+		// The piece was given up while this block was being read into its buffer
+		if state.orphaned {
+
+			s.recycle(state)
+			return
+		}
+
+	} else {
+
+		// The reader could not use the reservation, most likely because the length is wrong
+		if !s.unassign(peer, key) || len(event.Data) != s.blockLength(key) {
+			return
+		}
+
+		copy(state.buf[key.begin:], event.Data)
+		state.claimed++
+	}
+
+	block := key.begin / MaxBlockSize
+
+	state.owners[block] = nil
+	state.done.MarkPiece(block)
+	s.progressAt = time.Now()
+	state.downloaded += len(event.Data)
+	state.contributors[peer.client.Peer.String()] += len(event.Data)
+	state.senders[block] = peer.client.Peer.IP.String()
+
+	if state.downloaded == state.work.length {
+		s.finish(state)
+	}
+
+	s.fill(peer)
+}
+
+// finish hands a piece whose blocks have all arrived to the hashing pool
+func (s *scheduler) finish(state *pieceProgress) {
+
+	for i, active := range s.active {
+
+		if active == state {
+
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			break
+		}
+	}
+
+	s.hashing++
+
+	s.service.Config.hasher().Submit(state.buf, func(sum [20]byte) {
+
+		s.hashLock.Lock()
+		s.hashQueue = append(s.hashQueue, hashedPiece{state, sum == state.work.hash})
+		s.hashLock.Unlock()
+
+		select {
+		case s.hashReady <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// forwardHashed sends queued pieces on hashed, one at a time as the download takes them, until stopped is closed
+func (s *scheduler) forwardHashed() {
+
+	for {
+
+		select {
+		case <-s.hashReady:
+		case <-s.stopped:
+			return
+		}
+
+		for {
+
+			s.hashLock.Lock()
+			queue := s.hashQueue
+			s.hashQueue = nil
+			s.hashLock.Unlock()
+
+			if len(queue) == 0 {
+				break
+			}
+
+			for _, hashed := range queue {
+
+				select {
+				case s.hashed <- hashed:
+				case <-s.stopped:
+					return
+				}
+			}
+		}
+	}
+}
+
+// verified completes a hashed piece, or puts it back on the queue when its data was bad
+func (s *scheduler) verified(hashed hashedPiece) *pieceResult {
+
+	state := hashed.state
+	s.hashing--
+
+	if !hashed.ok {
+
+		s.recordFailure(state)
+
+		s.wanted.MarkPiece(state.work.index) // Put piece back on the queue
+		s.recycle(state)
+		s.fillAll()
+
+		return nil
+	}
+
+	s.blameCorrupt(state)
+
+	s.completed++
+	s.have.MarkPiece(state.work.index)
+
+	for client := range s.peers {
+		client.SendHave(state.work.index)
+	}
+
+	peers := make([]string, 0, len(state.contributors))
+
+	for address := range state.contributors {
+		peers = append(peers, address)
+	}
+
+	sort.Strings(peers)
+
+	return &pieceResult{index: state.work.index, buf: state.buf, peers: peers}
+}
+
+// penalize charges a peer for a protocol violation and disconnects it once it gets banned
+func (s *scheduler) penalize(peer *peerSession, points int, reason string) {
+
+	s.penalizeIP(peer.client.Peer.IP.String(), points, reason)
+}
+
+// penalizeIP charges whoever uses an IP, which may have disconnected already. Once banned, every
+// connection from the IP is closed.
+func (s *scheduler) penalizeIP(ip string, points int, reason string) {
+
+	if !s.service.bans.penalize(ip, points, s.service.Config.BanThreshold, reason) {
+		return
+	}
+
+	fmt.Printf("\nBanning %s: %s\n", ip, reason)
+
+	for client := range s.peers {
+
+		if client.Peer.IP.String() == ip {
+			client.Close()
+		}
+	}
+}
+
+func (s *scheduler) stats() []PeerStats {
+
+	stats := make([]PeerStats, 0, len(s.peers))
+
+	for _, peer := range s.peers {
+
+		stats = append(stats, PeerStats{
+
+			Peer:       peer.client.Peer.String(),
+			Choked:     peer.client.Choked(),
+			Downloaded: peer.pipeline.downloaded,
+			Rate:       peer.pipeline.rate,
+			RTT:        peer.pipeline.rtt,
+			QueueDepth: peer.pipeline.depth,
+			Backlog:    peer.pipeline.backlog(),
+			Reqq:       peer.client.Reqq(),
+		})
+	}
+
+	return stats
+}
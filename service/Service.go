@@ -1,28 +1,44 @@
 package service
 
 import (
-	"bytes"
-	"crypto/sha1"
 	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/ratelimit"
 	"fmt"
-	"os"
+	"sync"
 	"time"
 
 	tm "github.com/buger/goterm"
 )
 
 // MaxBlockSize is the largest number of bytes a request can ask for
-const MaxBlockSize = 16384
-
-// MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
-const MaxBacklog = 5
+const MaxBlockSize = model.BlockSize
 
 type TorrentService struct {
-	PeerID      [20]byte
-	Torrent     *model.TorrentFile
-	Clients     []*model.Client
-	WorkQueue   chan *pieceWork
-	ResultQueue chan *pieceResult
+	Config  Config
+	PeerID  [20]byte
+	Torrent *model.TorrentFile
+	Clients []*model.Client
+
+	statsLock sync.Mutex
+	peerStats []PeerStats
+
+	bans *banList
+
+	// Shared with readers streaming the content
+	progress *progress
+
+	// Rate limits shared by all connections of the torrent
+	limits *ratelimit.Limits
+
+	// Every peer we know of, and the state of our connection to it
+	pool *peerPool
+
+	priorityLock    sync.Mutex
+	filePriorities  []FilePriority
+	priorityVersion int
+
+	// Port peers connect to while the download runs, accessed atomically
+	listenPort int32
 }
 
 type pieceWork struct {
@@ -34,59 +50,115 @@ type pieceWork struct {
 type pieceResult struct {
 	index int
 	buf   []byte
+
+	// Addresses of the peers that sent blocks of the piece
+	peers []string
 }
 
+// pieceProgress is a piece being downloaded, possibly from several peers at once
 type pieceProgress struct {
-	index      int
-	client     *model.Client
+	work       *pieceWork
 	buf        []byte
 	downloaded int
-	requested  int
-	backlog    int
+
+	// Per block: the peer it is assigned to, if any, and whether it has arrived
+	owners []*peerSession
+	done   model.Bitfield
+
+	// Blocks assigned or done, nothing is left to request once it reaches len(owners)
+	claimed int
+
+	// Bytes received from each peer address, and the IP each block came from, empty for blocks read from disk
+	contributors map[string]int
+	senders      []string
+
+	// Blocks a reader goroutine may still be decoding into buf, which keeps buf out of the pool
+	reserved int
+	orphaned bool
 }
 
-func NewTorrentService(torrentPath string) (service *TorrentService) {
+func NewTorrentService(torrentPath string) (*TorrentService, error) {
 
-	service = new(TorrentService)
+	// Announcing with a predictable ID would make us look like every other client that failed here
+	peerID, err := model.NewPeerID()
 
-	copy(service.PeerID[:], "-TR0000-l9ik1xhfk7di")
+	if err != nil {
+
+		return nil, fmt.Errorf("generating peer ID: %w", err)
+	}
+
+	service := new(TorrentService)
+
+	service.Config = DefaultConfig()
+	service.bans = newBanList()
+	service.progress = newProgress()
+	service.limits = ratelimit.NewLimits(0, 0)
+	service.pool = newPeerPool()
+	service.PeerID = peerID
 
 	service.Torrent = model.MakeTorrentFile(torrentPath)
 
-	service.WorkQueue = make(chan *pieceWork, len(service.Torrent.PieceHashes))
-	service.ResultQueue = make(chan *pieceResult)
+	files := service.Torrent.ContentFiles()
+	service.filePriorities = make([]FilePriority, len(files))
+
+	for file := range service.filePriorities {
+
+		service.filePriorities[file] = PriorityNormal
+
+		// Nobody wants the zeros of padding files, pieces they share with real files still get downloaded
+		if files[file].Padding() {
+			service.filePriorities[file] = PrioritySkip
+		}
+	}
+
+	return service, nil
+}
+
+// ConnectionOptions describes connections to the torrent's peers as configured. All connections created
+// with them share the torrent's rate limits.
+func (service *TorrentService) ConnectionOptions() model.ConnectionOptions {
 
-	return service
+	return service.Config.connectionOptions(service.limits)
 }
 
-func (service *TorrentService) CreateClients() {
+// Announce asks the peer source, usually the tracker, for peers and adds them to the pool the download connects to
+func (service *TorrentService) Announce() error {
 
-	peersList, err := service.Torrent.RequestPeers(service.PeerID, 54788)
-	if err != nil {
+	peers, err := service.findPeers()
 
-		fmt.Println(err)
-		return
+	if err != nil {
+		return err
 	}
 
-	clientsCh := make(chan *model.Client)
+	fmt.Printf("Found %d peers, %d of them new.\n", len(peers), service.AddPeers(peers))
 
-	for _, peer := range peersList {
+	return nil
+}
+
+// addClient registers a connection unless we already have one to the same peer ID
+func (service *TorrentService) addClient(client *model.Client) bool {
+
+	for _, existing := range service.Clients {
 
-		go model.NewClient(peer, service.Torrent.InfoHash, service.PeerID, clientsCh)
+		if existing.RemotePeerID == client.RemotePeerID {
+			return false
+		}
 	}
 
-	for index := 0; index < len(peersList); index++ {
+	service.Clients = append(service.Clients, client)
 
-		client := <-clientsCh
+	return true
+}
 
-		if client == nil {
+func (service *TorrentService) removeClient(client *model.Client) {
 
-			continue
-		}
+	for i, existing := range service.Clients {
 
-		fmt.Printf("Successfully connected to %s.\n", client.Peer.String())
+		if existing == client {
 
-		service.Clients = append(service.Clients, client)
+			service.Clients = append(service.Clients[:i], service.Clients[i+1:]...)
+			return
+		}
 	}
 }
 
@@ -94,204 +166,194 @@ func (service *TorrentService) CloseConnections() {
 
 	for _, client := range service.Clients {
 
-		client.Connection.Close()
+		client.Close()
 	}
 }
 
-func (state *pieceProgress) readMessage() error {
+func (service *TorrentService) Download() (err error) {
 
-	msg, err := state.client.Read() // blocking
-	if err != nil {
-		return err
-	}
+	fmt.Printf("\nStarting download for %s...\n", service.Torrent.Name)
 
-	if msg == nil {
-		return nil
-	}
+	if len(service.Torrent.PieceHashes) != service.Torrent.NumPieces() {
 
-	switch msg.ID {
+		return fmt.Errorf("torrent has %d piece hashes but %d pieces", len(service.Torrent.PieceHashes), service.Torrent.NumPieces())
+	}
 
-	case model.MsgUnchoke:
-		state.client.Choked = false
+	var work []*pieceWork
 
-	case model.MsgChoke:
-		state.client.Choked = true
+	for index, hash := range service.Torrent.PieceHashes {
 
-	case model.MsgHave:
-		index, err := msg.ParseHave()
-		if err != nil {
-			return err
-		}
-		state.client.Bitfield.MarkPiece(index)
+		work = append(work, &pieceWork{index, hash, service.Torrent.PieceSize(index)})
+	}
 
-	case model.MsgPiece:
-		n, err := msg.ParsePieceMessage(state.index, state.buf)
-		if err != nil {
-			return err
-		}
+	// What is on disk before the storage creates or resizes anything
+	existing := service.statFiles()
 
-		state.downloaded += n
-		state.backlog--
-	}
+	// Verified pieces are written out as they arrive, so memory use does not grow with the torrent
+	store, err := service.Config.openStorage(service.Torrent)
 
-	return nil
-}
+	if err != nil {
 
-func attemptDownloadPiece(client *model.Client, work *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  work.index,
-		client: client,
-		buf:    make([]byte, work.length),
+		return err
 	}
 
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 256 KB piece
-	client.Connection.SetDeadline(time.Now().Add(30 * time.Second))
-	defer client.Connection.SetDeadline(time.Time{}) // Disable the deadline
+	// Readers may keep using the storage after the download stops
+	defer func() { service.progress.finish(store, err) }()
 
-	for state.downloaded < work.length {
+	scheduler := newScheduler(service, work)
+	defer close(scheduler.stopped)
 
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < work.length {
+	if err = service.restore(store, scheduler, existing); err != nil {
 
-				blockSize := MaxBlockSize
+		return err
+	}
 
-				// Last block might be shorter than the typical block
-				if work.length-state.requested < blockSize {
-					blockSize = work.length - state.requested
-				}
+	service.progress.start(store)
 
-				err := client.SendRequest(work.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
-			}
-		}
+	if err = service.applySkipped(store); err != nil {
 
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
-		}
+		return err
 	}
 
-	return state.buf, nil
-}
+	if err = service.checkFreeSpace(); err != nil {
 
-func checkIntegrity(work *pieceWork, buf []byte) error {
-
-	hash := sha1.Sum(buf)
-	if !bytes.Equal(hash[:], work.hash[:]) {
-		return fmt.Errorf("index %d failed integrity check", work.index)
+		return err
 	}
 
-	return nil
-}
+	// Whatever happens, the next run picks up where this one stopped
+	defer func() {
 
-func (service *TorrentService) downloadWorker(clientIndex int) {
+		if saveErr := service.saveResume(store, scheduler); err == nil {
+			err = saveErr
+		}
+	}()
+
+	events := make(chan model.Event, service.Config.MaxConnections)
 
-	client := service.Clients[clientIndex]
+	// Closed once the download returns. Sessions stop delivering events then, and the pool and the
+	// listener stop connecting peers.
+	stop := make(chan struct{})
+	defer close(stop)
 
-	client.SendUnchoke()
-	client.SendInterested()
+	connections := service.Clients
+	service.Clients = nil
 
-	for len(service.WorkQueue) > 0 {
+	for _, client := range connections {
 
-		work := <-service.WorkQueue
+		if !service.addClient(client) {
 
-		if !client.Bitfield.HasPiece(work.index) {
+			fmt.Printf("\nAlready connected to peer ID %q, dropping %s.\n", client.RemotePeerID[:], client.Peer.String())
+			client.Close()
 
-			service.WorkQueue <- work // Put piece back on the queue
 			continue
 		}
 
-		buffer, err := attemptDownloadPiece(client, work)
+		service.pool.connectedTo(client.Peer)
 
-		if err != nil {
+		client.Start(events, stop, service.Config.KeepAliveInterval, service.Config.IdleTimeout)
+		scheduler.addPeer(client)
+	}
 
-			service.WorkQueue <- work // Put piece back on the queue
-			continue
-		}
+	// More peers are connected as the pool finds them, and lost ones are replaced
+	connected := make(chan *model.Client)
 
-		err = checkIntegrity(work, buffer)
+	go service.maintainConnections(connected, stop)
 
-		if err != nil {
+	if service.Config.ListenAddress != "" {
 
-			service.WorkQueue <- work // Put piece back on the queue
-			continue
+		// Downloading works without it, as long as we find peers to connect to
+		if err := service.listen(connected, stop); err != nil {
+			fmt.Printf("Not accepting connections: %v\n", err)
 		}
+	}
 
-		client.SendHave(work.index)
-		service.ResultQueue <- &pieceResult{
+	tm.Clear()
+	tm.Flush()
 
-			index: work.index,
-			buf:   buffer,
-		}
-	}
-}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-func (service *TorrentService) writeToFile(buffer []byte) error {
+	lastSave := time.Now()
 
-	out, err := os.Create(service.Torrent.Name)
+	// Without peers or data for long, more peers are looked for until the download gives up
+	watch := new(stallWatch)
+	scheduler.progressAt = lastSave
 
-	if err != nil {
+	for scheduler.remaining() > 0 {
 
-		return err
-	}
-	defer out.Close()
+		var res *pieceResult
 
-	_, err = out.Write(buffer)
+		select {
 
-	if err != nil {
+		case event := <-events:
+			scheduler.handle(event)
 
-		return err
-	}
+			if event.Type == model.EventDisconnected {
 
-	return nil
-}
+				service.removeClient(event.Client)
+				service.pool.disconnected(event.Client.Peer, service.Config.RetryBackoff)
+			}
 
-func (service *TorrentService) Download() error {
+		case client := <-connected:
+			if !service.addClient(client) {
 
-	fmt.Printf("\nStarting download for %s...\n", service.Torrent.Name)
+				fmt.Printf("\nAlready connected to peer ID %q, dropping %s.\n", client.RemotePeerID[:], client.Peer.String())
+				client.Close()
+				service.pool.disconnected(client.Peer, service.Config.RetryBackoff)
 
-	for index, hash := range service.Torrent.PieceHashes {
+				continue
+			}
 
-		service.WorkQueue <- &pieceWork{index, hash, service.Torrent.PieceLength}
-	}
+			client.Start(events, stop, service.Config.KeepAliveInterval, service.Config.IdleTimeout)
+			scheduler.addPeer(client)
 
-	for clientIndex := range service.Clients {
+		case hashed := <-scheduler.hashed:
+			res = scheduler.verified(hashed)
 
-		go service.downloadWorker(clientIndex)
-	}
+		case now := <-ticker.C:
+			scheduler.tick(now)
+			service.printPeerStats()
 
-	// go service.downloadWorker(0)
+			if err = service.checkStall(scheduler, watch, now); err != nil {
+				return err
+			}
 
-	// Collect results into a buffer until full
-	buf := make([]byte, service.Torrent.Length)
-	donePieces := 0
+			if now.Sub(lastSave) >= service.Config.ResumeInterval {
 
-	tm.Clear()
-	tm.Flush()
+				if err = service.saveResume(store, scheduler); err != nil {
+					return err
+				}
+
+				lastSave = now
+			}
+		}
+
+		if res == nil {
+			continue
+		}
 
-	for donePieces < len(service.Torrent.PieceHashes) {
+		_, err = store.WriteAt(res.buf, res.index, 0)
+		scheduler.pieces.Put(res.buf)
 
-		res := <-service.ResultQueue
-		begin, end := res.index*service.Torrent.PieceLength, (res.index+1)*service.Torrent.PieceLength
+		if err == nil {
+			err = store.MarkComplete(res.index)
+		}
+
+		if err != nil {
 
-		copy(buf[begin:end], res.buf)
-		donePieces++
+			return writeError(res.index, err)
+		}
 
-		percent := float64(donePieces) / float64(len(service.Torrent.PieceHashes)) * 100
+		service.progress.markComplete(res.index)
+
+		selected := scheduler.selected.Count()
+		percent := float64(selected-scheduler.remaining()) / float64(selected) * 100
 
 		tm.MoveCursor(1, 1)
 		tm.Flush()
 
-		fmt.Printf("(%0.2f%%) Downloaded piece #%-6d from %d peers", percent, res.index, len(service.Clients))
+		fmt.Printf("(%0.2f%%) Downloaded piece #%-6d from %d of %d peers", percent, res.index, len(res.peers), len(scheduler.peers))
 	}
 
-	close(service.WorkQueue)
-
-	return service.writeToFile(buf)
+	return nil
 }
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"errors"
+	"example/bittorrent_in_go/storage"
+	"fmt"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrDiskFull stops a download that cannot write its data. Verified pieces stay on disk and the
+// download resumes once space has been freed.
+var ErrDiskFull = errors.New("disk full")
+
+// checkFreeSpace refuses to start when the wanted files cannot fit into the download directory
+func (service *TorrentService) checkFreeSpace() error {
+
+	// Only the built-in file storage is known to use the disk
+	if service.Config.Storage != nil {
+		return nil
+	}
+
+	free, err := storage.FreeSpace(service.Config.DownloadDir)
+
+	// Unknown free space is not a reason to refuse
+	if err != nil {
+		return nil
+	}
+
+	priorities := service.FilePriorities()
+	needed := int64(0)
+
+	for i, file := range service.Torrent.ContentFiles() {
+
+		if priorities[i] == PrioritySkip {
+			continue
+		}
+
+		missing := int64(file.Length) - storage.AllocatedSize(filepath.Join(service.Config.DownloadDir, file.Path))
+
+		if missing > 0 {
+			needed += missing
+		}
+	}
+
+	if needed > free {
+		return fmt.Errorf("%w: %s needs %d more bytes but only %d are available", ErrDiskFull, service.Config.DownloadDir, needed, free)
+	}
+
+	return nil
+}
+
+// writeError explains a failed write, turning a full disk into ErrDiskFull
+func writeError(index int, err error) error {
+
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: pausing, piece #%d could not be written: %v", ErrDiskFull, index, err)
+	}
+
+	return fmt.Errorf("writing piece #%d: %w", index, err)
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"errors"
+	"example/bittorrent_in_go/model"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultStallTimeout is how long a download may go without receiving data before it asks for more peers
+const DefaultStallTimeout = 30 * time.Second
+
+// DefaultGiveUpTimeout is how long a download may go without receiving data before it fails
+const DefaultGiveUpTimeout = 10 * time.Minute
+
+// ErrStalled ends a download that made no progress for Config.GiveUpTimeout
+var ErrStalled = errors.New("download stalled")
+
+// stallWatch re-announces while a download is stuck
+type stallWatch struct {
+	lastAnnounce time.Time
+	announcing   int32 // Accessed atomically
+}
+
+// findPeers asks the configured peer source, the tracker by default
+func (service *TorrentService) findPeers() ([]model.Peer, error) {
+
+	if service.Config.PeerSource != nil {
+		return service.Config.PeerSource()
+	}
+
+	return service.Torrent.RequestPeers(service.PeerID, service.announcePort())
+}
+
+// checkStall looks for new peers when the download has none to talk to or gets no data, and gives up once
+// nothing arrived for too long
+func (service *TorrentService) checkStall(scheduler *scheduler, watch *stallWatch, now time.Time) error {
+
+	idle := now.Sub(scheduler.progressAt)
+
+	if service.Config.GiveUpTimeout > 0 && idle >= service.Config.GiveUpTimeout {
+
+		return fmt.Errorf("%w: no data for %v with %d pieces left and %d peers connected",
+			ErrStalled, idle.Round(time.Second), scheduler.remaining(), len(scheduler.peers))
+	}
+
+	noPeers := len(scheduler.peers) == 0 && !service.pool.pending(service.bans)
+
+	if !noPeers && idle < service.Config.StallTimeout {
+		return nil
+	}
+
+	if now.Sub(watch.lastAnnounce) < service.Config.StallTimeout || !atomic.CompareAndSwapInt32(&watch.announcing, 0, 1) {
+		return nil
+	}
+
+	watch.lastAnnounce = now
+
+	fmt.Printf("\nNo data for %v, looking for more peers...\n", idle.Round(time.Second))
+
+	go func() {
+
+		defer atomic.StoreInt32(&watch.announcing, 0)
+
+		if err := service.Announce(); err != nil {
+			fmt.Printf("\nAnnounce failed: %v\n", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	tm "github.com/buger/goterm"
+)
+
+// statsRows is the number of peers listed below the progress line
+const statsRows = 10
+
+// PeerStats is a snapshot of one connection, refreshed every second while downloading
+type PeerStats struct {
+	Peer       string
+	Choked     bool
+	Downloaded int64
+	Rate       float64 // Bytes per second
+	RTT        time.Duration
+	QueueDepth int // Requests we currently aim to keep in flight
+	Backlog    int // Requests actually in flight
+	Reqq       int // Queue size advertised by the peer, 0 if unknown
+}
+
+func (service *TorrentService) setPeerStats(stats []PeerStats) {
+
+	service.statsLock.Lock()
+	defer service.statsLock.Unlock()
+
+	service.peerStats = stats
+}
+
+// PeerStats returns the latest per-peer statistics. Safe to call while Download runs.
+func (service *TorrentService) PeerStats() []PeerStats {
+
+	service.statsLock.Lock()
+	defer service.statsLock.Unlock()
+
+	return append([]PeerStats(nil), service.peerStats...)
+}
+
+// printPeerStats lists the fastest peers below the progress line
+func (service *TorrentService) printPeerStats() {
+
+	stats := service.PeerStats()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Rate > stats[j].Rate })
+
+	if len(stats) > statsRows {
+		stats = stats[:statsRows]
+	}
+
+	tm.MoveCursor(1, 3)
+	tm.Flush()
+
+	for _, peer := range stats {
+
+		fmt.Printf("%-22s %9.1f KiB/s  rtt %-8s queue %3d/%-3d  reqq %-4d\n",
+			peer.Peer, peer.Rate/1024, peer.RTT.Round(time.Millisecond), peer.Backlog, peer.QueueDepth, peer.Reqq)
+	}
+}
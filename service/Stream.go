@@ -0,0 +1,343 @@
+package service
+
+import (
+	"errors"
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/storage"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultReadahead is how much data after the read position a Reader asks to have downloaded first
+const DefaultReadahead = 4 << 20
+
+// PieceDeadlineStep is how much later than the previous one each piece ahead of a reader is needed
+const PieceDeadlineStep = time.Second
+
+// UrgentRequestTimeout replaces the request timeout for blocks of pieces a reader is already waiting for
+const UrgentRequestTimeout = 3 * time.Second
+
+var ErrReaderClosed = errors.New("reader closed")
+
+// progress shares the storage and the verified pieces of a running download with readers
+type progress struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	store    storage.Storage
+	complete model.Bitfield
+
+	// Set once the download loop has stopped, with the error reads of missing pieces fail with
+	finished bool
+	err      error
+
+	// Readers keep the storage open after the download has stopped
+	readers   int
+	deadlines map[*Reader]map[int]time.Time
+}
+
+func newProgress() *progress {
+
+	p := &progress{deadlines: make(map[*Reader]map[int]time.Time)}
+	p.cond = sync.NewCond(&p.lock)
+
+	return p
+}
+
+// start makes the storage available to readers
+func (p *progress) start(store storage.Storage) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.store = store
+	p.complete = store.Completion()
+	p.finished = false
+	p.err = nil
+
+	p.cond.Broadcast()
+}
+
+func (p *progress) markComplete(index int) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.complete.MarkPiece(index)
+
+	p.cond.Broadcast()
+}
+
+// finish is called when the download loop stops. The storage is closed once no reader uses it anymore.
+func (p *progress) finish(store storage.Storage, err error) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.finished = true
+	p.err = err
+
+	if err == nil {
+		p.err = errors.New("download stopped")
+	}
+
+	if p.readers == 0 {
+
+		store.Close()
+		p.store = nil
+	}
+
+	p.cond.Broadcast()
+}
+
+// urgent returns the earliest time any reader needs each of the pieces it waits for
+func (p *progress) urgent() map[int]time.Time {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.deadlines) == 0 {
+		return nil
+	}
+
+	urgent := make(map[int]time.Time)
+
+	for _, pieces := range p.deadlines {
+
+		for index, deadline := range pieces {
+
+			if current, ok := urgent[index]; !ok || deadline.Before(current) {
+				urgent[index] = deadline
+			}
+		}
+	}
+
+	return urgent
+}
+
+// Reader reads a file of the torrent while it downloads. Pieces around the read position
+// are downloaded ahead of everything else, and reads block until their piece is verified.
+type Reader struct {
+	service *TorrentService
+
+	// The file's range in the torrent's content
+	offset int64
+	length int64
+
+	pos       int64
+	readahead int64
+	closed    bool
+}
+
+// NewReader returns a reader over a file of the torrent. It may be created before Download is started.
+func (service *TorrentService) NewReader(file int) (*Reader, error) {
+
+	offset, length, err := service.fileRange(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := service.progress
+
+	p.lock.Lock()
+	p.readers++
+	p.lock.Unlock()
+
+	r := &Reader{service: service, offset: offset, length: length, readahead: DefaultReadahead}
+	r.prioritize()
+
+	return r, nil
+}
+
+// fileRange locates a file in the torrent's content
+func (service *TorrentService) fileRange(file int) (offset, length int64, err error) {
+
+	files := service.Torrent.ContentFiles()
+
+	if file < 0 || file >= len(files) {
+		return 0, 0, fmt.Errorf("no file #%d in torrent", file)
+	}
+
+	return int64(files[file].Offset), int64(files[file].Length), nil
+}
+
+// SetReadahead changes how many bytes after the read position are prioritized
+func (r *Reader) SetReadahead(n int64) {
+
+	r.readahead = n
+	r.prioritize()
+}
+
+// prioritize gives the pieces from the read position to the end of the readahead deadlines,
+// the piece under the read position being needed right now
+func (r *Reader) prioritize() {
+
+	p := r.service.progress
+	torrent := r.service.Torrent
+
+	pieces := make(map[int]time.Time)
+	now := time.Now()
+
+	if r.pos < r.length {
+
+		first := int((r.offset + r.pos) / int64(torrent.PieceLength))
+		last := int((r.offset + r.pos + r.readahead) / int64(torrent.PieceLength))
+		end := int((r.offset + r.length - 1) / int64(torrent.PieceLength))
+
+		if last > end {
+			last = end
+		}
+
+		for index := first; index <= last; index++ {
+			pieces[index] = now.Add(time.Duration(index-first) * PieceDeadlineStep)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	p.deadlines[r] = pieces
+}
+
+func (r *Reader) Read(buf []byte) (int, error) {
+
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+
+	torrent := r.service.Torrent
+	p := r.service.progress
+
+	at := r.offset + r.pos
+	index := int(at / int64(torrent.PieceLength))
+	begin, end := torrent.PieceBounds(index)
+
+	// Never read past the piece or the file
+	n := int64(len(buf))
+
+	if n > int64(end)-at {
+		n = int64(end) - at
+	}
+
+	if n > r.length-r.pos {
+		n = r.length - r.pos
+	}
+
+	p.lock.Lock()
+
+	for !r.closed && (p.store == nil || !p.complete.HasPiece(index)) && !p.finished {
+		p.cond.Wait()
+	}
+
+	store := p.store
+
+	switch {
+
+	case r.closed:
+		p.lock.Unlock()
+		return 0, ErrReaderClosed
+
+	case store == nil || !p.complete.HasPiece(index):
+		err := p.err
+		p.lock.Unlock()
+		return 0, err
+	}
+
+	p.lock.Unlock()
+
+	read, err := store.ReadAt(buf[:n], index, int(at)-begin)
+	r.pos += int64(read)
+
+	r.prioritize()
+
+	return read, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+
+	pos := offset
+
+	switch whence {
+
+	case io.SeekCurrent:
+		pos += r.pos
+
+	case io.SeekEnd:
+		pos += r.length
+	}
+
+	if pos < 0 {
+		return r.pos, fmt.Errorf("seek to negative position %d", pos)
+	}
+
+	r.pos = pos
+	r.prioritize()
+
+	return pos, nil
+}
+
+// Close drops the reader's priorities and wakes up a blocked Read
+func (r *Reader) Close() error {
+
+	p := r.service.progress
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if r.closed {
+		return nil
+	}
+
+	r.closed = true
+	p.readers--
+
+	delete(p.deadlines, r)
+
+	// The download has stopped and was only waiting for us
+	if p.finished && p.readers == 0 && p.store != nil {
+
+		p.store.Close()
+		p.store = nil
+	}
+
+	p.cond.Broadcast()
+
+	return nil
+}
+
+// urgentPieces lists the pieces readers wait for that peers can still deliver, earliest deadline first
+func (s *scheduler) urgentPieces(urgent map[int]time.Time) []int {
+
+	var pieces []int
+
+	for index := range urgent {
+
+		if index < len(s.work) && (s.wanted.HasPiece(index) || s.activePiece(index) != nil) {
+			pieces = append(pieces, index)
+		}
+	}
+
+	sort.Slice(pieces, func(i, j int) bool { return urgent[pieces[i]].Before(urgent[pieces[j]]) })
+
+	return pieces
+}
+
+func (s *scheduler) activePiece(index int) *pieceProgress {
+
+	for _, state := range s.active {
+
+		if state.work.index == index {
+			return state
+		}
+	}
+
+	return nil
+}
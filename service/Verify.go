@@ -0,0 +1,110 @@
+package service
+
+import (
+	"example/bittorrent_in_go/storage"
+	"fmt"
+	"sort"
+)
+
+// VerifyResult is the outcome of checking the data on disk against the torrent
+type VerifyResult struct {
+	Pieces int
+
+	// Indexes of the pieces that failed the hash check, in order
+	BadPieces []int
+
+	// Paths of the files holding data of bad pieces, relative to the download directory
+	BadFiles []string
+}
+
+// Percent is the share of pieces that passed the check
+func (r *VerifyResult) Percent() float64 {
+
+	if r.Pieces == 0 {
+		return 100
+	}
+
+	return float64(r.Pieces-len(r.BadPieces)) / float64(r.Pieces) * 100
+}
+
+// OK tells whether every piece passed the check
+func (r *VerifyResult) OK() bool {
+
+	return len(r.BadPieces) == 0
+}
+
+// Verify hash-checks the content in DownloadDir without connecting to any peer. Nothing on disk is
+// created or changed, missing files count as bad data.
+func (service *TorrentService) Verify() (*VerifyResult, error) {
+
+	torrent := service.Torrent
+
+	if len(torrent.PieceHashes) != torrent.NumPieces() {
+
+		return nil, fmt.Errorf("torrent has %d piece hashes but %d pieces", len(torrent.PieceHashes), torrent.NumPieces())
+	}
+
+	var store storage.Storage
+	var err error
+
+	if service.Config.Storage != nil {
+		store, err = service.Config.Storage(torrent)
+	} else {
+		store, err = storage.NewReadOnlyStorage(torrent, service.Config.DownloadDir)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer store.Close()
+
+	var work []*pieceWork
+
+	for index, hash := range torrent.PieceHashes {
+		work = append(work, &pieceWork{index, hash, torrent.PieceSize(index)})
+	}
+
+	result := &VerifyResult{Pieces: len(work)}
+
+	err = service.checkPieces(store, work, func(index int, ok bool) {
+
+		if !ok {
+			result.BadPieces = append(result.BadPieces, index)
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(result.BadPieces)
+
+	result.BadFiles = service.filesOf(result.BadPieces)
+
+	return result, nil
+}
+
+// filesOf lists the files holding data of any of the given sorted pieces
+func (service *TorrentService) filesOf(pieces []int) []string {
+
+	var paths []string
+
+	for i, file := range service.Torrent.ContentFiles() {
+
+		if file.Padding() {
+			continue
+		}
+
+		first, last := service.Torrent.FilePieces(i)
+
+		// The first bad piece not before the file's first piece
+		at := sort.SearchInts(pieces, first)
+
+		if at < len(pieces) && pieces[at] <= last {
+			paths = append(paths, file.Path)
+		}
+	}
+
+	return paths
+}
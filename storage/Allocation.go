@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+// Allocation decides how disk space for content files is reserved
+type Allocation int
+
+const (
+	// AllocateSparse sets the final file size without reserving blocks
+	AllocateSparse Allocation = iota
+
+	// AllocateFull reserves every block up front, so a full disk shows before the download starts
+	AllocateFull
+
+	// AllocateNone lets files grow as data is written
+	AllocateNone
+)
+
+func (a Allocation) String() string {
+
+	switch a {
+
+	case AllocateSparse:
+		return "sparse"
+
+	case AllocateFull:
+		return "full"
+
+	case AllocateNone:
+		return "none"
+	}
+
+	return fmt.Sprintf("Allocation(%d)", int(a))
+}
+
+// allocate grows a file to size as the allocation mode asks, without touching existing data
+func allocate(file *os.File, size int64, allocation Allocation) error {
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	switch allocation {
+
+	case AllocateNone:
+		// Only drop data past the end of the file
+		if info.Size() > size {
+			return file.Truncate(size)
+		}
+
+		return nil
+
+	case AllocateFull:
+		if err = fallocate(file, size); err != nil {
+			return err
+		}
+	}
+
+	return file.Truncate(size)
+}
+
+// zeroFill writes zeros from the end of the file up to size, for systems without fallocate
+func zeroFill(file *os.File, size int64) error {
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	zeros := make([]byte, 1<<20)
+
+	for off := info.Size(); off < size; off += int64(len(zeros)) {
+
+		if size-off < int64(len(zeros)) {
+			zeros = zeros[:size-off]
+		}
+
+		if _, err = file.WriteAt(zeros, off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
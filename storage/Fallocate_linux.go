@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func fallocate(file *os.File, size int64) error {
+
+	if size == 0 {
+		return nil
+	}
+
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+
+	// Some file systems cannot preallocate
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return zeroFill(file, size)
+	}
+
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+func fallocate(file *os.File, size int64) error {
+
+	return zeroFill(file, size)
+}
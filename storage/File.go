@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"example/bittorrent_in_go/model"
+	"os"
+	"path/filepath"
+)
+
+// FileStorage keeps the torrent's content in regular files below a download directory
+type FileStorage struct {
+	completion
+	*layout
+}
+
+// NewFileStorage lays the torrent out in dir. Files are allocated when first written to, existing data is kept.
+func NewFileStorage(torrent *model.TorrentFile, dir string, allocation Allocation) (*FileStorage, error) {
+
+	return &FileStorage{
+
+		completion: newCompletion(torrent.NumPieces()),
+		layout:     newLayout(torrent, dir, allocation, openFile),
+	}, nil
+}
+
+// FileOpener stores torrents as files in dir
+func FileOpener(dir string, allocation Allocation) Opener {
+
+	return func(torrent *model.TorrentFile) (Storage, error) {
+		return NewFileStorage(torrent, dir, allocation)
+	}
+}
+
+// NewReadOnlyStorage reads the torrent's content from dir without creating, resizing or writing any file.
+// Missing files read as zeros.
+func NewReadOnlyStorage(torrent *model.TorrentFile, dir string) (*FileStorage, error) {
+
+	return &FileStorage{
+
+		completion: newCompletion(torrent.NumPieces()),
+		layout:     newLayout(torrent, dir, AllocateNone, openReadOnly),
+	}, nil
+}
+
+func openReadOnly(path string, size int64, allocation Allocation) (region, error) {
+
+	return os.Open(path)
+}
+
+func openFile(path string, size int64, allocation Allocation) (region, error) {
+
+	return openSized(path, size, allocation)
+}
+
+func openSized(path string, size int64, allocation Allocation) (*os.File, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = allocate(file, size, allocation); err != nil {
+
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
@@ -0,0 +1,452 @@
+package storage
+
+import (
+	"errors"
+	"example/bittorrent_in_go/model"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// region is an open content file
+type region interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// layout spreads the torrent's content over its files. Files are only created once data is written
+// to them. Data of skipped files that have not been created goes to a part file instead, so pieces
+// they share with wanted files can still be verified. Padding files are never created, they read as zeros.
+type layout struct {
+	torrent *model.TorrentFile
+	files   []model.FileEntry
+	dir     string
+
+	allocation Allocation
+	open       func(path string, size int64, allocation Allocation) (region, error)
+
+	lock    sync.Mutex
+	regions []region
+	skipped []bool
+	parts   *os.File
+}
+
+func newLayout(torrent *model.TorrentFile, dir string, allocation Allocation, open func(string, int64, Allocation) (region, error)) *layout {
+
+	files := torrent.ContentFiles()
+
+	return &layout{
+
+		torrent: torrent,
+		files:   files,
+		dir:     dir,
+
+		allocation: allocation,
+		open:       open,
+		regions:    make([]region, len(files)),
+		skipped:    make([]bool, len(files)),
+	}
+}
+
+func (l *layout) path(file int) string {
+
+	return filepath.Join(l.dir, l.files[file].Path)
+}
+
+func (l *layout) partsPath() string {
+
+	top := strings.SplitN(l.files[0].Path, string(filepath.Separator), 2)[0]
+
+	return filepath.Join(l.dir, "."+top+".parts")
+}
+
+// region returns the open file, opening it if it exists on disk or create is set. It returns nil
+// if the file's data lives in the part file.
+func (l *layout) region(file int, create bool) (region, error) {
+
+	if l.regions[file] != nil {
+		return l.regions[file], nil
+	}
+
+	_, err := os.Stat(l.path(file))
+	exists := err == nil
+
+	if !exists && !create {
+		return nil, nil
+	}
+
+	r, err := l.open(l.path(file), int64(l.files[file].Length), l.allocation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Existing files keep whatever mode the user gave them
+	if !exists && l.files[file].Executable() {
+
+		if err = os.Chmod(l.path(file), 0755); err != nil {
+
+			r.Close()
+			return nil, err
+		}
+	}
+
+	l.regions[file] = r
+
+	return r, nil
+}
+
+func (l *layout) partFile(create bool) (*os.File, error) {
+
+	if l.parts != nil {
+		return l.parts, nil
+	}
+
+	flags := os.O_RDWR
+
+	if create {
+		flags |= os.O_CREATE
+	}
+
+	parts, err := os.OpenFile(l.partsPath(), flags, 0644)
+
+	if errors.Is(err, os.ErrNotExist) && !create {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	l.parts = parts
+
+	return parts, nil
+}
+
+// each calls fn for every file overlapping n bytes at off, with the file's index, the offset within the
+// file and the matching range of the buffer
+func (l *layout) each(off int64, n int, fn func(file int, fileOff int64, lo, hi int) error) error {
+
+	end := off + int64(n)
+
+	first := sort.Search(len(l.files), func(i int) bool {
+		return int64(l.files[i].Offset+l.files[i].Length) > off
+	})
+
+	for i := first; i < len(l.files) && int64(l.files[i].Offset) < end; i++ {
+
+		start := int64(l.files[i].Offset)
+		stop := start + int64(l.files[i].Length)
+
+		lo, hi := off, end
+
+		if lo < start {
+			lo = start
+		}
+
+		if hi > stop {
+			hi = stop
+		}
+
+		if lo >= hi {
+			continue
+		}
+
+		if err := fn(i, lo-start, int(lo-off), int(hi-off)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readFull reads like ReadAt but treats data past the end of a sparse file as zeros
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+
+	n, err := r.ReadAt(p, off)
+
+	if err == io.EOF {
+
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+func (l *layout) readAt(p []byte, off int64) error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.each(off, len(p), func(file int, fileOff int64, lo, hi int) error {
+
+		if l.files[file].Padding() {
+
+			for i := lo; i < hi; i++ {
+				p[i] = 0
+			}
+
+			return nil
+		}
+
+		r, err := l.region(file, false)
+
+		if err != nil {
+			return err
+		}
+
+		if r != nil {
+			return readFull(r, p[lo:hi], fileOff)
+		}
+
+		parts, err := l.partFile(false)
+
+		if err != nil {
+			return err
+		}
+
+		// Nothing has been written there yet
+		if parts == nil {
+
+			for i := lo; i < hi; i++ {
+				p[i] = 0
+			}
+
+			return nil
+		}
+
+		return readFull(parts, p[lo:hi], off+int64(lo))
+	})
+}
+
+func (l *layout) writeAt(p []byte, off int64) error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.each(off, len(p), func(file int, fileOff int64, lo, hi int) error {
+
+		// Only zeros go there, which verifying the piece has already checked
+		if l.files[file].Padding() {
+			return nil
+		}
+
+		r, err := l.region(file, !l.skipped[file])
+
+		if err != nil {
+			return err
+		}
+
+		if r != nil {
+
+			_, err = r.WriteAt(p[lo:hi], fileOff)
+			return err
+		}
+
+		parts, err := l.partFile(true)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = parts.WriteAt(p[lo:hi], off+int64(lo))
+
+		return err
+	})
+}
+
+func (l *layout) ReadAt(p []byte, index, begin int) (int, error) {
+
+	off, err := offset(l.torrent, index, begin, len(p))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err = l.readAt(p, off); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (l *layout) WriteAt(p []byte, index, begin int) (int, error) {
+
+	off, err := offset(l.torrent, index, begin, len(p))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err = l.writeAt(p, off); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// SetSkipped decides whether a file that has not been created yet should be left out. Files that
+// are wanted again are created with whatever the part file holds for them.
+func (l *layout) SetSkipped(file int, skipped bool) error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if file < 0 || file >= len(l.files) {
+		return ErrOutOfRange
+	}
+
+	wasSkipped := l.skipped[file]
+	l.skipped[file] = skipped
+
+	if skipped || !wasSkipped || !l.files[file].OnDisk() {
+		return nil
+	}
+
+	r, err := l.region(file, false)
+
+	if r != nil || err != nil {
+		return err
+	}
+
+	parts, err := l.partFile(false)
+
+	if parts == nil || err != nil {
+		return err
+	}
+
+	if r, err = l.region(file, true); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1<<20)
+	entry := l.files[file]
+
+	for done := 0; done < entry.Length; done += len(buf) {
+
+		if entry.Length-done < len(buf) {
+			buf = buf[:entry.Length-done]
+		}
+
+		if err = readFull(parts, buf, int64(entry.Offset+done)); err != nil {
+			return err
+		}
+
+		if _, err = r.WriteAt(buf, int64(done)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *layout) Flush() error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for file, entry := range l.files {
+
+		if l.skipped[file] || entry.Padding() {
+			continue
+		}
+
+		if entry.IsSymlink() {
+
+			if err := l.link(file); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// Empty files never see a write
+		if entry.Length == 0 {
+
+			if _, err := l.region(file, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range l.regions {
+
+		if r == nil {
+			continue
+		}
+
+		if err := r.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if l.parts != nil {
+		return l.parts.Sync()
+	}
+
+	return nil
+}
+
+// link creates a symlink file of the torrent. The link is relative and its target is a path inside the
+// torrent, so following it never leads out of the download directory.
+func (l *layout) link(file int) error {
+
+	path := l.path(file)
+
+	if _, err := os.Lstat(path); err == nil {
+		return nil
+	}
+
+	target, err := filepath.Rel(filepath.Dir(path), filepath.Join(l.dir, l.files[file].Symlink))
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return os.Symlink(target, path)
+}
+
+func (l *layout) Close() error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var err error
+
+	for i, r := range l.regions {
+
+		if r == nil {
+			continue
+		}
+
+		if closeErr := r.Close(); err == nil {
+			err = closeErr
+		}
+
+		l.regions[i] = nil
+	}
+
+	if l.parts != nil {
+
+		if closeErr := l.parts.Close(); err == nil {
+			err = closeErr
+		}
+
+		l.parts = nil
+	}
+
+	return err
+}
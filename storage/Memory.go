@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"example/bittorrent_in_go/model"
+	"sync"
+)
+
+// MemoryStorage keeps the whole torrent in memory, e.g. for tests or small payloads
+type MemoryStorage struct {
+	completion
+
+	torrent *model.TorrentFile
+	lock    sync.RWMutex
+	data    []byte
+}
+
+func NewMemoryStorage(torrent *model.TorrentFile) *MemoryStorage {
+
+	return &MemoryStorage{
+
+		completion: newCompletion(torrent.NumPieces()),
+		torrent:    torrent,
+		data:       make([]byte, torrent.Length),
+	}
+}
+
+// MemoryOpener keeps torrents in memory
+func MemoryOpener(torrent *model.TorrentFile) (Storage, error) {
+
+	return NewMemoryStorage(torrent), nil
+}
+
+func (s *MemoryStorage) ReadAt(p []byte, index, begin int) (int, error) {
+
+	off, err := offset(s.torrent, index, begin, len(p))
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return copy(p, s.data[off:]), nil
+}
+
+func (s *MemoryStorage) WriteAt(p []byte, index, begin int) (int, error) {
+
+	off, err := offset(s.torrent, index, begin, len(p))
+
+	if err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return copy(s.data[off:], p), nil
+}
+
+// Bytes returns the content, only safe to use once nothing writes anymore
+func (s *MemoryStorage) Bytes() []byte {
+
+	return s.data
+}
+
+func (s *MemoryStorage) Flush() error {
+
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+
+	return nil
+}
@@ -0,0 +1,146 @@
+//go:build linux || darwin
+
+package storage
+
+import (
+	"example/bittorrent_in_go/model"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"syscall"
+	"unsafe"
+)
+
+// MmapStorage maps the content files into memory and lets the kernel page them in and out
+type MmapStorage struct {
+	completion
+	*layout
+}
+
+// NewMmapStorage lays the torrent out in dir like NewFileStorage. A mapping needs the whole file, so
+// AllocateNone is treated as AllocateSparse. Prefer AllocateFull: writing to a sparse mapping on a full
+// disk faults instead of failing the write.
+func NewMmapStorage(torrent *model.TorrentFile, dir string, allocation Allocation) (*MmapStorage, error) {
+
+	if allocation == AllocateNone {
+		allocation = AllocateSparse
+	}
+
+	return &MmapStorage{
+
+		completion: newCompletion(torrent.NumPieces()),
+		layout:     newLayout(torrent, dir, allocation, openMmap),
+	}, nil
+}
+
+// MmapOpener stores torrents as memory-mapped files in dir
+func MmapOpener(dir string, allocation Allocation) Opener {
+
+	return func(torrent *model.TorrentFile) (Storage, error) {
+		return NewMmapStorage(torrent, dir, allocation)
+	}
+}
+
+type mmapRegion struct {
+	file *os.File
+	data []byte
+}
+
+func openMmap(path string, size int64, allocation Allocation) (region, error) {
+
+	file, err := openSized(path, size, allocation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := &mmapRegion{file: file}
+
+	// Empty files cannot be mapped
+	if size == 0 {
+		return r, nil
+	}
+
+	r.data, err = syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+
+	if err != nil {
+
+		file.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *mmapRegion) ReadAt(p []byte, off int64) (int, error) {
+
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.data[off:])
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (r *mmapRegion) WriteAt(p []byte, off int64) (n int, err error) {
+
+	// Blocks of a sparse mapping are allocated on first write, which faults when the disk is full
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+
+	defer func() {
+
+		if recover() != nil {
+			n, err = 0, fmt.Errorf("storage: fault writing to mapped %s, the disk may be full: %w", r.file.Name(), syscall.ENOSPC)
+		}
+	}()
+
+	if off >= int64(len(r.data)) {
+		return 0, io.ErrShortWrite
+	}
+
+	n = copy(r.data[off:], p)
+
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+func (r *mmapRegion) Sync() error {
+
+	if len(r.data) == 0 {
+		return nil
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&r.data[0])), uintptr(len(r.data)), syscall.MS_SYNC)
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func (r *mmapRegion) Close() error {
+
+	var err error
+
+	if r.data != nil {
+
+		err = syscall.Munmap(r.data)
+		r.data = nil
+	}
+
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,27 @@
+//go:build !linux && !darwin
+
+package storage
+
+import (
+	"errors"
+	"example/bittorrent_in_go/model"
+)
+
+var errMmapUnsupported = errors.New("storage: mmap is not supported on this platform")
+
+type MmapStorage struct {
+	completion
+	*layout
+}
+
+func NewMmapStorage(torrent *model.TorrentFile, dir string, allocation Allocation) (*MmapStorage, error) {
+
+	return nil, errMmapUnsupported
+}
+
+func MmapOpener(dir string, allocation Allocation) Opener {
+
+	return func(torrent *model.TorrentFile) (Storage, error) {
+		return nil, errMmapUnsupported
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux && !darwin
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+func FreeSpace(dir string) (int64, error) {
+
+	return 0, errors.New("storage: free space is unknown on this platform")
+}
+
+// AllocatedSize falls back to the file size where sparse files cannot be detected
+func AllocatedSize(path string) int64 {
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
@@ -0,0 +1,44 @@
+//go:build linux || darwin
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to us on the file system holding dir, which need not exist yet
+func FreeSpace(dir string) (int64, error) {
+
+	var stat syscall.Statfs_t
+
+	for {
+
+		err := syscall.Statfs(dir, &stat)
+
+		if err == nil {
+			return int64(stat.Bavail) * int64(stat.Bsize), nil
+		}
+
+		parent := filepath.Dir(dir)
+
+		if !os.IsNotExist(err) || parent == dir {
+			return 0, err
+		}
+
+		dir = parent
+	}
+}
+
+// AllocatedSize returns the bytes a file actually occupies on disk, which is less than its size if it is sparse
+func AllocatedSize(path string) int64 {
+
+	var stat syscall.Stat_t
+
+	if syscall.Stat(path, &stat) != nil {
+		return 0
+	}
+
+	return int64(stat.Blocks) * 512
+}
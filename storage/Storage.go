@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"errors"
+	"example/bittorrent_in_go/model"
+	"fmt"
+	"sync"
+)
+
+var ErrOutOfRange = errors.New("storage: access outside of the piece")
+
+// Storage holds the content of one torrent, addressed by piece index and offset within the piece
+type Storage interface {
+	ReadAt(p []byte, index, begin int) (int, error)
+	WriteAt(p []byte, index, begin int) (int, error)
+
+	// MarkComplete records that a piece has been written and verified
+	MarkComplete(index int) error
+	Completion() model.Bitfield
+
+	// Flush makes written data durable
+	Flush() error
+	Close() error
+}
+
+// Skipper is implemented by storages that can leave files of a torrent out
+type Skipper interface {
+	SetSkipped(file int, skipped bool) error
+}
+
+// Opener creates the storage for a torrent
+type Opener func(torrent *model.TorrentFile) (Storage, error)
+
+// offset translates a piece-relative range into an offset in the torrent's content
+func offset(torrent *model.TorrentFile, index, begin, length int) (int64, error) {
+
+	if index < 0 || index >= torrent.NumPieces() || begin < 0 || begin+length > torrent.PieceSize(index) {
+		return 0, fmt.Errorf("%w: piece %d, %d bytes at %d", ErrOutOfRange, index, length, begin)
+	}
+
+	start, _ := torrent.PieceBounds(index)
+
+	return int64(start + begin), nil
+}
+
+// completion tracks verified pieces for the backends
+type completion struct {
+	lock      sync.Mutex
+	complete  model.Bitfield
+	numPieces int
+}
+
+func newCompletion(numPieces int) completion {
+
+	return completion{complete: model.NewBitfield(numPieces), numPieces: numPieces}
+}
+
+func (c *completion) MarkComplete(index int) error {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if index < 0 || index >= c.numPieces {
+		return fmt.Errorf("%w: piece %d", ErrOutOfRange, index)
+	}
+
+	c.complete.MarkPiece(index)
+
+	return nil
+}
+
+// Completion returns a copy of the verified pieces
+func (c *completion) Completion() model.Bitfield {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.complete.Clone()
+}
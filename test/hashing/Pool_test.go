@@ -0,0 +1,124 @@
+package test
+
+import (
+	"crypto/sha1"
+	"example/bittorrent_in_go/hashing"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolSum(t *testing.T) {
+
+	pool := hashing.NewPool(2)
+	defer pool.Close()
+
+	data := []byte("some piece data")
+
+	assert.Equal(t, sha1.Sum(data), pool.Sum(data))
+}
+
+func TestPoolBoundsConcurrency(t *testing.T) {
+
+	const workers = 3
+
+	pool := hashing.NewPool(workers)
+	defer pool.Close()
+
+	var running, peak int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+
+		wg.Add(1)
+
+		pool.Submit([]byte{byte(i)}, func(sum [20]byte) {
+
+			now := atomic.AddInt32(&running, 1)
+
+			for {
+				old := atomic.LoadInt32(&peak)
+
+				if now <= old || atomic.CompareAndSwapInt32(&peak, old, now) {
+					break
+				}
+			}
+
+			time.Sleep(5 * time.Millisecond)
+
+			atomic.AddInt32(&running, -1)
+			wg.Done()
+		})
+	}
+
+	wg.Wait()
+
+	assert.LessOrEqual(t, peak, int32(workers))
+	assert.Greater(t, peak, int32(1))
+}
+
+func TestPoolFinishesQueuedWorkOnClose(t *testing.T) {
+
+	pool := hashing.NewPool(1)
+
+	var done int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+
+		wg.Add(1)
+		pool.Submit(make([]byte, 1024), func([20]byte) { atomic.AddInt32(&done, 1); wg.Done() })
+	}
+
+	pool.Close()
+	wg.Wait()
+
+	assert.Equal(t, int32(10), done)
+}
+
+const benchPieceLength = 256 << 10
+
+func benchmarkPool(b *testing.B, workers int) {
+
+	pool := hashing.NewPool(workers)
+	defer pool.Close()
+
+	piece := make([]byte, benchPieceLength)
+
+	b.SetBytes(benchPieceLength)
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+
+	for i := 0; i < b.N; i++ {
+		pool.Submit(piece, func([20]byte) { wg.Done() })
+	}
+
+	wg.Wait()
+}
+
+func BenchmarkInline(b *testing.B) {
+
+	piece := make([]byte, benchPieceLength)
+
+	b.SetBytes(benchPieceLength)
+
+	for i := 0; i < b.N; i++ {
+		sha1.Sum(piece)
+	}
+}
+
+func BenchmarkPoolOneWorker(b *testing.B) {
+
+	benchmarkPool(b, 1)
+}
+
+func BenchmarkPoolAllCPUs(b *testing.B) {
+
+	benchmarkPool(b, runtime.NumCPU())
+}
@@ -9,12 +9,15 @@ import (
 
 func TestBitfield(t *testing.T) {
 
-	bf := make(model.Bitfield, 4)
+	bf, err := model.ParseBitfield([]byte{
 
-	bf[0] = 1   // 00000001
-	bf[1] = 128 // 10000000
-	bf[2] = 8   // 00001000
-	bf[3] = 56  // 00011100
+		1,   // 00000001
+		128, // 10000000
+		8,   // 00001000
+		56,  // 00011100
+	}, 32)
+
+	assert.Nil(t, err)
 
 	indexes := map[int]bool{
 
@@ -39,3 +42,74 @@ func TestBitfield(t *testing.T) {
 
 	assert.Equal(t, bf.HasPiece(15), true)
 }
+
+func TestBitfieldBounds(t *testing.T) {
+
+	bf := model.NewBitfield(10)
+
+	assert.Equal(t, 10, bf.Length())
+	assert.Equal(t, 2, len(bf.Bytes()))
+
+	// Piece 10 still fits in the second byte, but is not one of the 10 pieces
+	assert.False(t, bf.MarkPiece(10))
+	assert.False(t, bf.MarkPiece(1<<30))
+	assert.False(t, bf.MarkPiece(-1))
+	assert.False(t, bf.ClearPiece(10))
+
+	bf.SetRange(8, 16)
+
+	assert.False(t, bf.HasPiece(10))
+	assert.False(t, bf.HasPiece(1<<30))
+	assert.False(t, bf.HasPiece(-1))
+	assert.Equal(t, []int{8, 9}, bf.Pieces())
+	assert.Equal(t, []byte{0x00, 0xc0}, bf.Bytes())
+}
+
+func TestBitfieldValidate(t *testing.T) {
+
+	payload := []byte{0xff, 0xc0}
+
+	bf, err := model.ParseBitfield(payload, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, bf.Count())
+
+	_, err = model.ParseBitfield(payload, 9) // Spare bit set
+	assert.NotNil(t, err)
+
+	_, err = model.ParseBitfield(payload, 17) // Too short
+	assert.NotNil(t, err)
+
+	_, err = model.ParseBitfield(payload, 8) // Too long
+	assert.NotNil(t, err)
+}
+
+func TestBitfieldRangesAndIteration(t *testing.T) {
+
+	bf := model.NewBitfield(20)
+
+	bf.SetRange(3, 11)
+	bf.ClearPiece(5)
+	bf.MarkPiece(19)
+
+	assert.Equal(t, 8, bf.Count())
+	assert.Equal(t, []int{3, 4, 6, 7, 8, 9, 10, 19}, bf.Pieces())
+}
+
+func TestBitfieldAlgebra(t *testing.T) {
+
+	a, _ := model.ParseBitfield([]byte{0xf0, 0x0f}, 16)
+	b, _ := model.ParseBitfield([]byte{0x3c, 0xff}, 16)
+
+	and, andNot, or := a.And(b), a.AndNot(b), a.Or(b)
+
+	assert.Equal(t, []byte{0x30, 0x0f}, and.Bytes())
+	assert.Equal(t, []byte{0xc0, 0x00}, andNot.Bytes())
+	assert.Equal(t, []byte{0xfc, 0xff}, or.Bytes())
+
+	// A longer bitfield never adds pieces past the length of the first
+	short := model.NewBitfield(12)
+	or = short.Or(b)
+
+	assert.Equal(t, []byte{0x3c, 0xf0}, or.Bytes())
+	assert.Equal(t, 12, or.Length())
+}
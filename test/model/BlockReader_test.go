@@ -0,0 +1,182 @@
+package test
+
+import (
+	"bytes"
+	"example/bittorrent_in_go/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const benchPieceLength = 256 * 1024
+const benchBlockLength = 16 * 1024
+
+// pieceStream serializes one whole piece as the PIECE messages a peer would send
+func pieceStream(index int) []byte {
+
+	var stream []byte
+
+	for begin := 0; begin < benchPieceLength; begin += benchBlockLength {
+
+		payload := make([]byte, 8+benchBlockLength)
+
+		payload[3] = byte(index)
+		payload[5] = byte(begin >> 16)
+		payload[6] = byte(begin >> 8)
+
+		for i := 8; i < len(payload); i++ {
+			payload[i] = byte(begin + i)
+		}
+
+		msg := model.Message{ID: model.MsgPiece, Payload: payload}
+		stream = append(stream, msg.Serialize()...)
+	}
+
+	return stream
+}
+
+func TestBlockReaderDecodesIntoTarget(t *testing.T) {
+
+	stream := pieceStream(1)
+	piece := make([]byte, benchPieceLength)
+
+	target := func(index, begin, length int) []byte {
+
+		if begin == benchBlockLength {
+			return nil // Not reserved, goes through the pool
+		}
+
+		return piece[begin : begin+length]
+	}
+
+	reader := model.NewBlockReader(bytes.NewReader(stream), nil)
+
+	for begin := 0; begin < benchPieceLength; begin += benchBlockLength {
+
+		msg, block, err := reader.Next(target)
+
+		assert.Nil(t, err)
+		assert.Nil(t, msg)
+		assert.Equal(t, 1, block.Index)
+		assert.Equal(t, begin, block.Begin)
+		assert.Equal(t, begin != benchBlockLength, block.Reserved)
+		assert.Equal(t, byte(begin+8), block.Data[0])
+	}
+
+	assert.Equal(t, byte(8), piece[0])
+	assert.Equal(t, byte(0), piece[benchBlockLength]) // The pooled block was not written to the piece
+}
+
+func TestBlockReaderPoolsOnlyRequestSizedBlocks(t *testing.T) {
+
+	assert.Equal(t, model.BlockSize, model.BlockPool.Size())
+
+	var stream []byte
+
+	for _, size := range []int{model.BlockSize, model.BlockSize + 1, model.MaxBlockLength} {
+
+		msg := model.Message{ID: model.MsgPiece, Payload: make([]byte, 8+size)}
+		stream = append(stream, msg.Serialize()...)
+	}
+
+	reader := model.NewBlockReader(bytes.NewReader(stream), nil)
+
+	_, block, err := reader.Next(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, model.BlockSize, cap(block.Data))
+
+	// Oversize blocks are read whole, into buffers of their own
+	for _, size := range []int{model.BlockSize + 1, model.MaxBlockLength} {
+
+		_, block, err = reader.Next(nil)
+		assert.Nil(t, err)
+		assert.False(t, block.Reserved)
+		assert.Equal(t, size, len(block.Data))
+		assert.Equal(t, size, cap(block.Data))
+
+		model.BlockPool.Put(block.Data)
+	}
+}
+
+// BenchmarkReadMessageCopy is the old path: a fresh message per block, copied into the piece buffer
+func BenchmarkReadMessageCopy(b *testing.B) {
+
+	stream := pieceStream(1)
+	reader := bytes.NewReader(stream)
+
+	b.ReportAllocs()
+	b.SetBytes(benchPieceLength)
+
+	for n := 0; n < b.N; n++ {
+
+		reader.Reset(stream)
+		piece := make([]byte, benchPieceLength)
+
+		for begin := 0; begin < benchPieceLength; begin += benchBlockLength {
+
+			msg, err := model.ReadMessage(reader)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			msg.ParsePieceMessage(1, piece)
+		}
+	}
+}
+
+// BenchmarkBlockReaderDirect decodes every block straight into a pooled piece buffer
+func BenchmarkBlockReaderDirect(b *testing.B) {
+
+	stream := pieceStream(1)
+	reader := bytes.NewReader(stream)
+	blocks := model.NewBlockReader(reader, nil)
+	pieces := model.NewBufferPool(benchPieceLength)
+
+	b.ReportAllocs()
+	b.SetBytes(benchPieceLength)
+
+	for n := 0; n < b.N; n++ {
+
+		reader.Reset(stream)
+		piece := pieces.Get(benchPieceLength)
+
+		target := func(index, begin, length int) []byte { return piece[begin : begin+length] }
+
+		for begin := 0; begin < benchPieceLength; begin += benchBlockLength {
+
+			if _, _, err := blocks.Next(target); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		pieces.Put(piece)
+	}
+}
+
+// BenchmarkBlockReaderPooled reads blocks without a reservation into BlockPool buffers
+func BenchmarkBlockReaderPooled(b *testing.B) {
+
+	stream := pieceStream(1)
+	reader := bytes.NewReader(stream)
+	blocks := model.NewBlockReader(reader, nil)
+	piece := make([]byte, benchPieceLength)
+
+	b.ReportAllocs()
+	b.SetBytes(benchPieceLength)
+
+	for n := 0; n < b.N; n++ {
+
+		reader.Reset(stream)
+
+		for begin := 0; begin < benchPieceLength; begin += benchBlockLength {
+
+			_, block, err := blocks.Next(nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			copy(piece[block.Begin:], block.Data)
+			model.BlockPool.Put(block.Data)
+		}
+	}
+}
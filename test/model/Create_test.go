@@ -0,0 +1,150 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"example/bittorrent_in_go/hashing"
+	"example/bittorrent_in_go/model"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateMultiFileTorrent(t *testing.T) {
+
+	const pieceLength = 1000
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "album")
+
+	lengths := map[string]int{"a.bin": 1500, filepath.Join("sub", "b.bin"): 0, filepath.Join("sub", "c.bin"): 2700}
+	var content []byte
+
+	// Files are concatenated in lexical order of their paths
+	for _, name := range []string{"a.bin", filepath.Join("sub", "b.bin"), filepath.Join("sub", "c.bin")} {
+
+		data := make([]byte, lengths[name])
+		rand.Read(data)
+
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755))
+		assert.Nil(t, os.WriteFile(filepath.Join(root, name), data, 0644))
+
+		content = append(content, data...)
+	}
+
+	buf, err := model.CreateTorrent(root, model.CreateOptions{Announce: "http://tracker/announce", PieceLength: pieceLength, Hasher: hashing.NewPool(2)})
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, "album.torrent")
+	assert.Nil(t, os.WriteFile(path, buf, 0644))
+
+	torrent := model.MakeTorrentFile(path)
+
+	assert.Equal(t, "http://tracker/announce", torrent.Announce)
+	assert.Equal(t, "album", torrent.Name)
+	assert.Equal(t, len(content), torrent.Length)
+	assert.Len(t, torrent.Files, 3)
+	assert.Equal(t, filepath.Join("album", "sub", "c.bin"), torrent.Files[2].Path)
+	assert.Equal(t, 1500, torrent.Files[2].Offset)
+
+	assert.Len(t, torrent.PieceHashes, 5)
+
+	for index, hash := range torrent.PieceHashes {
+
+		begin, end := torrent.PieceBounds(index)
+		assert.Equal(t, sha1.Sum(content[begin:end]), hash)
+	}
+}
+
+func TestCreateSingleFileTorrent(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "movie.mkv")
+
+	assert.Nil(t, os.WriteFile(path, []byte("short content"), 0644))
+
+	buf, err := model.CreateTorrent(path, model.CreateOptions{Announce: "http://tracker/announce"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(path+".torrent", buf, 0644))
+
+	torrent := model.MakeTorrentFile(path + ".torrent")
+
+	assert.Equal(t, "movie.mkv", torrent.Name)
+	assert.Equal(t, 13, torrent.Length)
+	assert.Equal(t, [][20]byte{sha1.Sum([]byte("short content"))}, torrent.PieceHashes)
+}
+
+func TestCreateAlignsFilesWithPadding(t *testing.T) {
+
+	const pieceLength = 1000
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "tool")
+
+	a := make([]byte, 1500)
+	b := make([]byte, 700)
+	rand.Read(a)
+	rand.Read(b)
+
+	assert.Nil(t, os.MkdirAll(root, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "a.bin"), a, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "b.bin"), b, 0644))
+	assert.Nil(t, os.Symlink("a.bin", filepath.Join(root, "link")))
+	assert.Nil(t, os.Symlink(filepath.Join(dir, "elsewhere"), filepath.Join(root, "outside")))
+
+	buf, err := model.CreateTorrent(root, model.CreateOptions{Announce: "http://tracker/announce", PieceLength: pieceLength, Align: true})
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, "tool.torrent")
+	assert.Nil(t, os.WriteFile(path, buf, 0644))
+
+	torrent := model.MakeTorrentFile(path)
+
+	// Links leading out of the directory are left out
+	assert.Equal(t, []model.FileEntry{
+
+		{Path: filepath.Join("tool", "a.bin"), Length: 1500, Offset: 0, Attr: "x"},
+		{Path: filepath.Join("tool", ".pad", "500"), Length: 500, Offset: 1500, Attr: "p"},
+		{Path: filepath.Join("tool", "b.bin"), Length: 700, Offset: 2000},
+		{Path: filepath.Join("tool", "link"), Offset: 2700, Attr: "l", Symlink: filepath.Join("tool", "a.bin")},
+	}, torrent.Files)
+
+	assert.True(t, torrent.Files[1].Padding())
+	assert.True(t, torrent.Files[0].Executable())
+	assert.True(t, torrent.Files[3].IsSymlink())
+
+	content := append(append(a, make([]byte, 500)...), b...)
+
+	assert.Len(t, torrent.PieceHashes, 3)
+
+	for index, hash := range torrent.PieceHashes {
+
+		begin, end := torrent.PieceBounds(index)
+		assert.Equal(t, sha1.Sum(content[begin:end]), hash)
+	}
+}
+
+func TestParseFileAttributes(t *testing.T) {
+
+	sum := sha1.Sum([]byte("file"))
+
+	info := "d5:filesl" +
+		"d4:attr1:h6:lengthi4e4:pathl7:.hiddene4:sha120:" + string(sum[:]) + "e" +
+		"d4:attr1:l6:lengthi0e4:pathl4:linke12:symlink pathl2:..7:.hiddenee" +
+		"e4:name4:root12:piece lengthi4e6:pieces20:" + string(sum[:]) + "e"
+
+	path := filepath.Join(t.TempDir(), "attr.torrent")
+	assert.Nil(t, os.WriteFile(path, []byte("d8:announce17:http://localhost/4:info"+info+"e"), 0644))
+
+	torrent := model.MakeTorrentFile(path)
+
+	assert.True(t, torrent.Files[0].Hidden())
+	assert.Equal(t, sum[:], torrent.Files[0].SHA1)
+
+	// Symlink targets cannot climb out of the torrent either
+	assert.True(t, torrent.Files[1].IsSymlink())
+	assert.Equal(t, filepath.Join("root", "_", ".hidden"), torrent.Files[1].Symlink)
+}
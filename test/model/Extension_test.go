@@ -0,0 +1,50 @@
+package test
+
+import (
+	"example/bittorrent_in_go/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+
+	msg := model.MakeExtendedHandshakeMessage()
+
+	hs, err := msg.ParseExtendedHandshake()
+
+	assert.Nil(t, err)
+	assert.Equal(t, model.OurReqq, hs.Reqq)
+	assert.Equal(t, model.ClientCode+" "+model.ClientVersion, hs.Version)
+}
+
+func TestExtendedHandshakeFromPeer(t *testing.T) {
+
+	payload := append([]byte{0}, "d1:md11:ut_metadatai3ee4:reqqi1000e1:v13:qBittorrent 4e"...)
+	msg := model.Message{ID: model.MsgExtended, Payload: payload}
+
+	hs, err := msg.ParseExtendedHandshake()
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, hs.Reqq)
+	assert.Equal(t, "qBittorrent 4", hs.Version)
+}
+
+func TestExtendedHandshakeMalformed(t *testing.T) {
+
+	msg := model.Message{ID: model.MsgExtended, Payload: append([]byte{0}, "d4:reqqi"...)}
+
+	_, err := msg.ParseExtendedHandshake()
+
+	assert.NotNil(t, err)
+}
+
+func TestHandshakeAdvertisesExtensions(t *testing.T) {
+
+	var infoHash, peerID [20]byte
+
+	hs := model.NewHandshake(infoHash, peerID)
+
+	assert.True(t, hs.SupportsExtensions())
+	assert.Equal(t, byte(0x10), hs.Serialize()[1+19+5])
+}
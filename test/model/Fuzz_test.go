@@ -0,0 +1,112 @@
+package test
+
+import (
+	"bytes"
+	"example/bittorrent_in_go/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Run with e.g. go test ./test/model -fuzz FuzzReadMessage -fuzztime 30s
+
+func FuzzReadMessage(f *testing.F) {
+
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add(model.MakeHaveMessage(7).Serialize())
+	f.Add(model.MakeRequestMessage(1, 16384, 16384).Serialize())
+	f.Add(model.MakeCancelMessage(1, 0, 16384).Serialize())
+	f.Add(model.MakeExtendedHandshakeMessage().Serialize())
+	f.Add((&model.Message{ID: model.MsgPiece, Payload: []byte{0, 0, 0, 1, 0, 0, 0, 0, 'x'}}).Serialize())
+	f.Add((&model.Message{ID: model.MsgBitfield, Payload: []byte{0xff, 0x80}}).Serialize())
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, model.MsgPiece})
+
+	limits := model.DefaultMessageLimits(9, nil)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		msg, err := model.ReadMessageLimited(bytes.NewReader(data), limits)
+
+		if err != nil || msg == nil {
+			return
+		}
+
+		serialized := msg.Serialize()
+
+		assert.Equal(t, data[:len(serialized)], serialized)
+
+		// No parser may panic, whatever the message claims to be
+		msg.ParseHave()
+		msg.ParseRequest()
+		msg.ParsePiece()
+		msg.ParsePieceMessage(1, make([]byte, 32))
+		msg.ParseExtendedHandshake()
+
+		model.ParseBitfield(msg.Payload, 9)
+	})
+}
+
+func FuzzReadHandshake(f *testing.F) {
+
+	var infoHash, peerID [20]byte
+
+	f.Add(model.NewHandshake(infoHash, peerID).Serialize())
+	f.Add([]byte{0})
+	f.Add([]byte{255, 'B'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		hs, err := model.ReadHandshake(bytes.NewReader(data))
+
+		if err != nil {
+			return
+		}
+
+		assert.Equal(t, data[:68], hs.Serialize())
+	})
+}
+
+func FuzzParseBitfield(f *testing.F) {
+
+	f.Add([]byte{0xff, 0x80}, 9)
+	f.Add([]byte{0xff, 0xc0}, 9)
+	f.Add([]byte{}, 0)
+
+	f.Fuzz(func(t *testing.T, data []byte, length int) {
+
+		if length < 0 || length > 1<<16 {
+			return
+		}
+
+		bitfield, err := model.ParseBitfield(data, length)
+
+		if err != nil {
+			return
+		}
+
+		assert.LessOrEqual(t, bitfield.Count(), length)
+
+		for _, index := range bitfield.Pieces() {
+			assert.Less(t, index, length)
+		}
+	})
+}
+
+func FuzzParseExtendedHandshake(f *testing.F) {
+
+	f.Add(model.MakeExtendedHandshakeMessage().Payload)
+	f.Add(append([]byte{0}, "d4:reqqi-1ee"...))
+	f.Add(append([]byte{0}, "d99999999999999999999:x"...))
+	f.Add(append([]byte{0}, "llllllllllle"...))
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+
+		msg := model.Message{ID: model.MsgExtended, Payload: payload}
+
+		hs, err := msg.ParseExtendedHandshake()
+
+		if err == nil && hs != nil {
+			assert.GreaterOrEqual(t, hs.Reqq, 0)
+		}
+	})
+}
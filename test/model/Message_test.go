@@ -0,0 +1,47 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"example/bittorrent_in_go/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMessageRejectsOversized(t *testing.T) {
+
+	// A 4 GiB piece announcement must fail before anything gets allocated
+	data := []byte{0xff, 0xff, 0xff, 0xff, model.MsgPiece}
+
+	_, err := model.ReadMessageLimited(bytes.NewReader(data), model.DefaultMessageLimits(10, nil))
+
+	var violation *model.ProtocolError
+	assert.True(t, errors.As(err, &violation))
+
+	// A HAVE must be exactly 5 bytes long
+	have := append(model.MakeHaveMessage(1).Serialize(), 0)
+	have[3] = 6
+
+	_, err = model.ReadMessageLimited(bytes.NewReader(have), model.DefaultMessageLimits(10, nil))
+	assert.True(t, errors.As(err, &violation))
+}
+
+func TestReadMessageLimitOverride(t *testing.T) {
+
+	limits := model.DefaultMessageLimits(10, map[uint8]uint32{model.MsgExtended: 8})
+
+	msg := model.MakeExtendedHandshakeMessage()
+
+	_, err := model.ReadMessageLimited(bytes.NewReader(msg.Serialize()), limits)
+	assert.NotNil(t, err)
+}
+
+func TestReadHandshakeRejectsUnknownProtocol(t *testing.T) {
+
+	data := append([]byte{19}, "BitTorrent protocoX"...)
+	data = append(data, make([]byte, 48)...)
+
+	_, err := model.ReadHandshake(bytes.NewReader(data))
+	assert.NotNil(t, err)
+}
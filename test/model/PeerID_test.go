@@ -0,0 +1,20 @@
+package test
+
+import (
+	"example/bittorrent_in_go/model"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPeerID(t *testing.T) {
+
+	a, err := model.NewPeerID()
+	assert.Nil(t, err)
+
+	b, err := model.NewPeerID()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "-GQ0100-", string(a[:8]))
+	assert.NotEqual(t, a, b)
+}
@@ -0,0 +1,313 @@
+package test
+
+import (
+	"errors"
+	"example/bittorrent_in_go/model"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connectedPair returns a started client and the raw connection of the peer it talks to
+func connectedPair(t *testing.T, events chan model.Event) (*model.Client, net.Conn) {
+
+	client, peer := acceptedPair(t)
+	client.Start(events, nil, time.Minute, time.Minute)
+
+	return client, peer
+}
+
+// acceptedPair returns a client that has completed the handshake but is not started yet
+func acceptedPair(t *testing.T) (*model.Client, net.Conn) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	var infoHash, peerID, remotePeerID [20]byte
+	copy(infoHash[:], "infohashinfohashinfo")
+	copy(remotePeerID[:], "-XX0000-remotepeerid")
+
+	peer, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err)
+
+	// Small buffers fill up quickly when the peer stops reading
+	conn.(*net.TCPConn).SetWriteBuffer(4096)
+	peer.(*net.TCPConn).SetReadBuffer(4096)
+
+	go func() {
+
+		peer.Write(model.NewHandshake(infoHash, remotePeerID).Serialize())
+		model.ReadHandshake(peer)
+
+		bitfield := model.Message{ID: model.MsgBitfield, Payload: []byte{0x80}}
+		peer.Write(bitfield.Serialize())
+	}()
+
+	client, err := model.AcceptClient(conn, infoHash, 8, peerID, model.ConnectionOptions{})
+	assert.Nil(t, err)
+
+	assert.Equal(t, remotePeerID, client.RemotePeerID)
+
+	return client, peer
+}
+
+func nextEvent(t *testing.T, events chan model.Event) model.Event {
+
+	select {
+
+	case event := <-events:
+		return event
+
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+
+	return model.Event{}
+}
+
+// lastEvent skips events up to EventDisconnected and returns it
+func lastEvent(t *testing.T, events chan model.Event) model.Event {
+
+	for {
+
+		event := nextEvent(t, events)
+
+		if event.Type == model.EventDisconnected {
+			return event
+		}
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+
+	events := make(chan model.Event, 16)
+
+	client, peer := connectedPair(t, events)
+	defer client.Close()
+
+	assert.Equal(t, model.EventBitfield, nextEvent(t, events).Type)
+	assert.True(t, client.HasPiece(0))
+	assert.True(t, client.Choked())
+
+	unchoke := model.Message{ID: model.MsgUnchoke}
+	peer.Write(unchoke.Serialize())
+	peer.Write(model.MakeHaveMessage(3).Serialize())
+
+	assert.Equal(t, model.EventUnchoked, nextEvent(t, events).Type)
+	assert.False(t, client.Choked())
+
+	have := nextEvent(t, events)
+	assert.Equal(t, model.EventHave, have.Type)
+	assert.Equal(t, 3, have.Index)
+	assert.True(t, client.HasPiece(3))
+
+	piece := model.Message{ID: model.MsgPiece, Payload: []byte{0, 0, 0, 1, 0, 0, 0, 2, 'a', 'b'}}
+	peer.Write(piece.Serialize())
+
+	block := nextEvent(t, events)
+	assert.Equal(t, model.EventPiece, block.Type)
+	assert.Equal(t, 1, block.Index)
+	assert.Equal(t, 2, block.Begin)
+	assert.Equal(t, "ab", string(block.Data))
+
+	peer.Close()
+
+	disconnected := nextEvent(t, events)
+	assert.Equal(t, model.EventDisconnected, disconnected.Type)
+	assert.Equal(t, client, disconnected.Client)
+}
+
+func TestSessionWrites(t *testing.T) {
+
+	events := make(chan model.Event, 16)
+
+	client, peer := connectedPair(t, events)
+	defer client.Close()
+
+	client.SendRequest(1, 2, 3)
+
+	peer.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// The extension handshake comes first
+	msg, err := model.ReadMessage(peer)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MsgExtended, msg.ID)
+
+	msg, err = model.ReadMessage(peer)
+	assert.Nil(t, err)
+
+	index, begin, length, err := msg.ParseRequest()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3}, []int{index, begin, length})
+}
+
+func TestSessionSendsKeepAlives(t *testing.T) {
+
+	events := make(chan model.Event, 16)
+
+	client, peer := acceptedPair(t)
+	defer client.Close()
+	defer peer.Close()
+
+	client.Start(events, nil, 500*time.Millisecond, time.Minute)
+
+	peer.SetDeadline(time.Now().Add(3 * time.Second))
+
+	msg, err := model.ReadMessage(peer)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MsgExtended, msg.ID)
+
+	// Nothing else is written, so the next message is a keep-alive
+	msg, err = model.ReadMessage(peer)
+	assert.Nil(t, err)
+	assert.Nil(t, msg)
+}
+
+func TestSessionDisconnectsIdlePeer(t *testing.T) {
+
+	events := make(chan model.Event, 16)
+
+	client, peer := acceptedPair(t)
+	defer client.Close()
+	defer peer.Close()
+
+	start := time.Now()
+	client.Start(events, nil, time.Minute, 300*time.Millisecond)
+
+	disconnected := lastEvent(t, events)
+
+	assert.True(t, errors.Is(disconnected.Err, model.ErrIdle))
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestSessionDisconnectsPeerThatStopsReading(t *testing.T) {
+
+	events := make(chan model.Event, 16)
+
+	client, peer := connectedPair(t, events)
+	defer client.Close()
+	defer peer.Close()
+
+	// Fills the socket buffers, then the outbox, without the peer reading anything
+	sent := make(chan error, 1)
+
+	go func() {
+
+		for {
+
+			if err := client.SendRequest(0, 0, model.BlockSize); err != nil {
+
+				sent <- err
+				return
+			}
+		}
+	}()
+
+	select {
+
+	case err := <-sent:
+		assert.Equal(t, model.ErrOutboxFull, err)
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("sending to a peer that does not read blocked")
+	}
+
+	select {
+
+	case <-client.Done():
+
+	case <-time.After(2 * time.Second):
+		t.Fatal("client still open")
+	}
+
+	assert.Equal(t, model.ErrOutboxFull, lastEvent(t, events).Err)
+}
+
+// A peer that neither reads nor sends is disconnected even while a write to it is blocked
+func TestSessionDisconnectsDeadPeer(t *testing.T) {
+
+	events := make(chan model.Event, 16)
+
+	client, peer := acceptedPair(t)
+	defer client.Close()
+	defer peer.Close()
+
+	client.Start(events, nil, time.Minute, 500*time.Millisecond)
+
+	// More than the socket buffers hold, paced so the writer gets to block on them
+	for batch := 0; batch < 3; batch++ {
+
+		for i := 0; i < model.OutboxSize/2; i++ {
+			client.SendRequest(0, 0, model.BlockSize)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	select {
+
+	case <-client.Done():
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer was never disconnected")
+	}
+
+	assert.Equal(t, model.EventDisconnected, lastEvent(t, events).Type)
+	assert.NotNil(t, client.SendHave(1))
+}
+
+func TestSelfConnectionRejected(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	var infoHash, peerID [20]byte
+	copy(peerID[:], "-GQ0100-ourselves123")
+
+	peer, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer peer.Close()
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err)
+
+	go peer.Write(model.NewHandshake(infoHash, peerID).Serialize())
+
+	_, err = model.AcceptClient(conn, infoHash, 8, peerID, model.ConnectionOptions{})
+
+	assert.Equal(t, model.ErrSelfConnection, err)
+}
+
+func TestSessionEndsOnceEventsAreNoLongerRead(t *testing.T) {
+
+	events := make(chan model.Event) // Nobody reads
+	stop := make(chan struct{})
+
+	client, peer := acceptedPair(t)
+	defer peer.Close()
+
+	client.Start(events, stop, time.Minute, time.Minute)
+	close(stop)
+
+	select {
+
+	case <-client.Done():
+
+	case <-time.After(2 * time.Second):
+		t.Fatal("session kept waiting for its events to be read")
+	}
+
+	// The connection is closed too, rather than left open without anyone to act on the peer's messages
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, err := io.Copy(io.Discard, peer)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"crypto/sha1"
+	"example/bittorrent_in_go/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPieceGeometry(t *testing.T) {
+
+	torrent := &model.TorrentFile{PieceLength: 2*model.BlockSize + 100, Length: 5*model.BlockSize + 300}
+
+	assert.Equal(t, 3, torrent.NumPieces())
+
+	begin, end := torrent.PieceBounds(1)
+	assert.Equal(t, 2*model.BlockSize+100, begin)
+	assert.Equal(t, 4*model.BlockSize+200, end)
+
+	begin, end = torrent.PieceBounds(2)
+	assert.Equal(t, 4*model.BlockSize+200, begin)
+	assert.Equal(t, torrent.Length, end)
+
+	assert.Equal(t, torrent.PieceLength, torrent.PieceSize(0))
+	assert.Equal(t, model.BlockSize+100, torrent.PieceSize(2))
+
+	assert.Equal(t, 3, torrent.BlockCount(0))
+	assert.Equal(t, model.BlockSize, torrent.BlockSize(0, 1))
+	assert.Equal(t, 100, torrent.BlockSize(0, 2))
+
+	assert.Equal(t, 2, torrent.BlockCount(2))
+	assert.Equal(t, model.BlockSize, torrent.BlockSize(2, 0))
+	assert.Equal(t, 100, torrent.BlockSize(2, 1))
+}
+
+func TestPieceGeometryExactMultiple(t *testing.T) {
+
+	torrent := &model.TorrentFile{PieceLength: 4 * model.BlockSize, Length: 8 * model.BlockSize}
+
+	assert.Equal(t, 2, torrent.NumPieces())
+	assert.Equal(t, torrent.PieceLength, torrent.PieceSize(1))
+	assert.Equal(t, 4, torrent.BlockCount(1))
+	assert.Equal(t, model.BlockSize, torrent.BlockSize(1, 3))
+}
+
+func TestMultiFileTorrent(t *testing.T) {
+
+	pieces := strings.Repeat("x", 3*20)
+
+	info := "d5:filesl" +
+		"d6:lengthi10e4:pathl1:a5:b.txtee" +
+		"d6:lengthi0e4:pathl5:emptyee" +
+		"d6:lengthi30e4:pathl2:..6:escapeee" +
+		"e4:name4:root12:piece lengthi16e6:pieces60:" + pieces + "e"
+
+	path := filepath.Join(t.TempDir(), "multi.torrent")
+	assert.Nil(t, os.WriteFile(path, []byte("d8:announce17:http://localhost/4:info"+info+"e"), 0644))
+
+	torrent := model.MakeTorrentFile(path)
+
+	assert.Equal(t, 40, torrent.Length)
+	assert.Equal(t, 3, torrent.NumPieces())
+	assert.Equal(t, sha1.Sum([]byte(info)), torrent.InfoHash)
+
+	assert.Equal(t, []model.FileEntry{
+
+		{Path: filepath.Join("root", "a", "b.txt"), Length: 10, Offset: 0},
+		{Path: filepath.Join("root", "empty"), Length: 0, Offset: 10},
+		{Path: filepath.Join("root", "_", "escape"), Length: 30, Offset: 10},
+	}, torrent.Files)
+
+	first, last := torrent.FilePieces(0)
+	assert.Equal(t, []int{0, 0}, []int{first, last})
+
+	first, last = torrent.FilePieces(1)
+	assert.Less(t, last, first)
+
+	first, last = torrent.FilePieces(2)
+	assert.Equal(t, []int{0, 2}, []int{first, last})
+}
+
+func TestSingleFileContentFiles(t *testing.T) {
+
+	torrent := &model.TorrentFile{Name: "../file", Length: 5, PieceLength: 4}
+
+	// Separators inside a name never reach the file system
+	assert.Equal(t, []model.FileEntry{{Path: ".._file", Length: 5}}, torrent.ContentFiles())
+}
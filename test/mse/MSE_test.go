@@ -0,0 +1,113 @@
+package test
+
+import (
+	"example/bittorrent_in_go/mse"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type acceptResult struct {
+	conn *mse.Conn
+	skey [20]byte
+	err  error
+}
+
+func handshake(t *testing.T, provide uint32, policy mse.Policy) (*mse.Conn, error, acceptResult) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	var skey [20]byte
+	copy(skey[:], "01234567890123456789")
+
+	other := [20]byte{1}
+
+	accepted := make(chan acceptResult, 1)
+
+	go func() {
+
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- acceptResult{err: err}
+			return
+		}
+
+		c, key, err := mse.Accept(conn, [][20]byte{other, skey}, policy)
+		if err != nil {
+			conn.Close()
+		}
+
+		accepted <- acceptResult{c, key, err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+
+	c, err := mse.Initiate(conn, skey, provide)
+
+	return c, err, <-accepted
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+
+	initiator, err, responder := handshake(t, mse.CryptoRC4|mse.CryptoPlaintext, mse.PolicyPrefer)
+
+	assert.Nil(t, err)
+	assert.Nil(t, responder.err)
+	assert.Equal(t, byte('0'), responder.skey[0])
+	assert.True(t, initiator.Encrypted())
+	assert.True(t, responder.conn.Encrypted())
+
+	go initiator.Write([]byte("\x13BitTorrent protocol"))
+
+	buf := make([]byte, 20)
+	_, err = io.ReadFull(responder.conn, buf)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "\x13BitTorrent protocol", string(buf))
+
+	go responder.conn.Write([]byte("reply"))
+
+	buf = make([]byte, 5)
+	_, err = io.ReadFull(initiator, buf)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "reply", string(buf))
+}
+
+func TestPlaintextSelected(t *testing.T) {
+
+	initiator, err, responder := handshake(t, mse.CryptoPlaintext, mse.PolicyPrefer)
+
+	assert.Nil(t, err)
+	assert.Nil(t, responder.err)
+	assert.False(t, initiator.Encrypted())
+	assert.False(t, responder.conn.Encrypted())
+}
+
+func TestRequirePolicyRejectsPlaintext(t *testing.T) {
+
+	_, _, responder := handshake(t, mse.CryptoPlaintext, mse.PolicyRequire)
+
+	assert.Equal(t, mse.ErrNotAllowed, responder.err)
+}
+
+func TestPlaintextHandshakePassesThrough(t *testing.T) {
+
+	client, server := net.Pipe()
+
+	go client.Write([]byte("\x13BitTorrent protocol"))
+
+	conn, _, err := mse.Accept(server, nil, mse.PolicyPrefer)
+	assert.Nil(t, err)
+
+	buf := make([]byte, 20)
+	_, err = io.ReadFull(conn, buf)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "\x13BitTorrent protocol", string(buf))
+}
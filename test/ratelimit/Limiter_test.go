@@ -0,0 +1,94 @@
+package test
+
+import (
+	"example/bittorrent_in_go/ratelimit"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// transfer writes n bytes into one end of a pipe and returns how long reading them from the limited end took
+func transfer(t *testing.T, n int, wrap func(net.Conn) net.Conn) time.Duration {
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go remote.Write(make([]byte, n))
+
+	start := time.Now()
+
+	_, err := io.ReadFull(wrap(local), make([]byte, n))
+	assert.Nil(t, err)
+
+	return time.Since(start)
+}
+
+func TestUnlimitedConn(t *testing.T) {
+
+	elapsed := transfer(t, 1<<20, func(conn net.Conn) net.Conn {
+		return ratelimit.NewConn(conn, ratelimit.NewLimits(0, 0))
+	})
+
+	assert.Less(t, elapsed, 200*time.Millisecond)
+}
+
+func TestConnDownloadLimit(t *testing.T) {
+
+	// 64 KiB of burst, then 192 KiB at 256 KiB/s
+	elapsed := transfer(t, 256<<10, func(conn net.Conn) net.Conn {
+		return ratelimit.NewConn(conn, ratelimit.NewLimits(256<<10, 0))
+	})
+
+	assert.Greater(t, elapsed, 600*time.Millisecond)
+	assert.Less(t, elapsed, 1500*time.Millisecond)
+}
+
+func TestSlowestLevelWins(t *testing.T) {
+
+	global := ratelimit.NewLimits(0, 0)
+	peer := ratelimit.NewLimits(128<<10, 0)
+
+	elapsed := transfer(t, 96<<10, func(conn net.Conn) net.Conn {
+		return ratelimit.NewConn(conn, global, peer)
+	})
+
+	// 32 KiB of burst, then 64 KiB at 128 KiB/s
+	assert.Greater(t, elapsed, 400*time.Millisecond)
+}
+
+func TestConnUploadLimit(t *testing.T) {
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go io.Copy(io.Discard, remote)
+
+	conn := ratelimit.NewConn(local, ratelimit.NewLimits(0, 128<<10))
+
+	start := time.Now()
+
+	n, err := conn.Write(make([]byte, 96<<10))
+	assert.Nil(t, err)
+	assert.Equal(t, 96<<10, n)
+
+	assert.Greater(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestLimiterSetRate(t *testing.T) {
+
+	limiter := ratelimit.NewLimiter(1000)
+	assert.Equal(t, 1000, limiter.Rate())
+
+	limiter.SetRate(-5)
+	assert.Equal(t, 0, limiter.Rate())
+
+	start := time.Now()
+	ratelimit.WaitN(10<<20, limiter, nil)
+
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+}
@@ -0,0 +1,122 @@
+package test
+
+import (
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/service"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// poolSwarm starts seeders the download only learns about through its peer pool
+func poolSwarm(t *testing.T, svc *service.TorrentService, data []byte, n int, configure func(*seeder)) []*seeder {
+
+	var swarm []*seeder
+	var peers []model.Peer
+
+	for i := 0; i < n; i++ {
+
+		s := newSeeder(t, svc.Torrent, data)
+		t.Cleanup(func() { s.listener.Close() })
+
+		if configure != nil {
+			configure(s)
+		}
+
+		swarm = append(swarm, s)
+		peers = append(peers, s.peer())
+	}
+
+	assert.Equal(t, n, svc.AddPeers(peers))
+	assert.Equal(t, 0, svc.AddPeers(peers))
+
+	return swarm
+}
+
+func TestDownloadConnectsToPoolPeers(t *testing.T) {
+
+	data := randomData(t, 8*testPieceLength)
+	dir := t.TempDir()
+
+	var swarm []*seeder
+
+	_, err := download(t, dir, data, func(svc *service.TorrentService, _ []*seeder) {
+
+		swarm = poolSwarm(t, svc, data, 2, nil)
+
+	}, 0)
+
+	assert.Nil(t, err)
+	assert.Equal(t, data, readContent(t, dir))
+
+	for _, s := range swarm {
+		assert.Greater(t, atomic.LoadInt64(&s.served), int64(0))
+	}
+}
+
+func TestDownloadReconnectsDroppedPeers(t *testing.T) {
+
+	data := randomData(t, 8*testPieceLength)
+	dir := t.TempDir()
+
+	_, err := download(t, dir, data, func(svc *service.TorrentService, _ []*seeder) {
+
+		// Every connection ends after a few blocks, so the download needs several
+		poolSwarm(t, svc, data, 1, func(s *seeder) { s.drop = 5 })
+
+	}, 0)
+
+	assert.Nil(t, err)
+	assert.Equal(t, data, readContent(t, dir))
+}
+
+func TestDownloadKeepsConnectionLimit(t *testing.T) {
+
+	data := randomData(t, 8*testPieceLength)
+	dir := t.TempDir()
+
+	var swarm []*seeder
+
+	_, err := download(t, dir, data, func(svc *service.TorrentService, _ []*seeder) {
+
+		svc.Config.MaxConnections = 1
+
+		swarm = poolSwarm(t, svc, data, 3, func(s *seeder) { s.drop = 3 })
+
+	}, 0)
+
+	assert.Nil(t, err)
+	assert.Equal(t, data, readContent(t, dir))
+
+	// Dropped connections are replaced by connections to the other seeders, one at a time
+	used := 0
+
+	for _, s := range swarm {
+
+		assert.LessOrEqual(t, atomic.LoadInt64(&s.peak), int64(1))
+
+		if atomic.LoadInt64(&s.served) > 0 {
+			used++
+		}
+	}
+
+	assert.Greater(t, used, 1)
+}
+
+func TestDownloadFailsWithoutPeers(t *testing.T) {
+
+	data := randomData(t, 2*testPieceLength)
+
+	_, err := download(t, t.TempDir(), data, func(svc *service.TorrentService, _ []*seeder) {
+
+		// Nobody listens there anymore
+		s := newSeeder(t, svc.Torrent, data)
+		s.listener.Close()
+
+		svc.AddPeers([]model.Peer{s.peer()})
+
+	}, 0)
+
+	assert.NotNil(t, err)
+}
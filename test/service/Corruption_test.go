@@ -0,0 +1,94 @@
+package test
+
+import (
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/service"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newSeederOn starts a seeder listening on another loopback address, serving data that may differ from the torrent's
+func newSeederOn(t *testing.T, ip string, torrent *model.TorrentFile, data []byte) *seeder {
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", ip, err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	s := &seeder{listener: listener, data: data, torrent: torrent}
+
+	go s.serve()
+
+	return s
+}
+
+func TestDownloadBansPeerSendingCorruptData(t *testing.T) {
+
+	data := randomData(t, 16*testPieceLength)
+
+	corrupt := append([]byte(nil), data...)
+
+	for i := 0; i < len(corrupt); i += 1000 {
+		corrupt[i] ^= 0xff
+	}
+
+	dir := t.TempDir()
+
+	var torrent *service.TorrentService
+
+	_, err := download(t, dir, data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		torrent = svc
+
+		swarm[1].listener.Close()
+		swarm[1] = newSeederOn(t, "127.0.0.2", svc.Torrent, corrupt)
+
+	}, 2)
+
+	assert.Nil(t, err)
+	assert.Equal(t, data, readContent(t, dir))
+
+	banned := torrent.Banned()
+
+	assert.Contains(t, banned, "127.0.0.2")
+	assert.NotContains(t, banned, "127.0.0.1")
+}
+
+func TestDownloadBansPeerSendingUnrequestedBlocks(t *testing.T) {
+
+	data := randomData(t, 16*testPieceLength)
+	dir := t.TempDir()
+
+	var torrent *service.TorrentService
+	var spammer *seeder
+
+	_, err := download(t, dir, data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		torrent = svc
+
+		swarm[1].listener.Close()
+		swarm[1] = newSeederOn(t, "127.0.0.2", svc.Torrent, data)
+
+		// Enough to go over the ban threshold even if a few of them happen to have been requested
+		swarm[1].unrequested = 2 * service.DefaultBanThreshold / service.PenaltyUnrequestedBlock
+
+		spammer = swarm[1]
+
+	}, 2)
+
+	assert.Nil(t, err)
+	assert.Equal(t, data, readContent(t, dir))
+
+	assert.Contains(t, torrent.Banned(), "127.0.0.2")
+	assert.NotContains(t, torrent.Banned(), "127.0.0.1")
+
+	// Disconnected and never dialed again
+	assert.Equal(t, int64(0), atomic.LoadInt64(&spammer.open))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&spammer.accepted))
+}
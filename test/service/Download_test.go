@@ -0,0 +1,517 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/mse"
+	"example/bittorrent_in_go/service"
+	"example/bittorrent_in_go/storage"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPieceLength = 2 * service.MaxBlockSize
+
+// writeTorrent creates a .torrent describing data and returns its path. Without file lengths it is a
+// single-file torrent named content.bin, otherwise the files are named f0, f1, ... in a content directory.
+func writeTorrent(t *testing.T, dir string, data []byte, lengths ...int) string {
+
+	var pieces strings.Builder
+
+	for begin := 0; begin < len(data); begin += testPieceLength {
+
+		end := begin + testPieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+
+		hash := sha1.Sum(data[begin:end])
+		pieces.Write(hash[:])
+	}
+
+	var info string
+
+	if len(lengths) == 0 {
+
+		info = fmt.Sprintf("d6:lengthi%de4:name11:content.bin12:piece lengthi%de6:pieces%d:%se",
+			len(data), testPieceLength, pieces.Len(), pieces.String())
+
+	} else {
+
+		var files strings.Builder
+
+		for i, length := range lengths {
+
+			name := fmt.Sprintf("f%d", i)
+			fmt.Fprintf(&files, "d6:lengthi%de4:pathl%d:%see", length, len(name), name)
+		}
+
+		info = fmt.Sprintf("d5:filesl%se4:name7:content12:piece lengthi%de6:pieces%d:%se",
+			files.String(), testPieceLength, pieces.Len(), pieces.String())
+	}
+
+	torrent := "d8:announce17:http://localhost/4:info" + info + "e"
+	path := filepath.Join(dir, "content.torrent")
+
+	assert.Nil(t, os.WriteFile(path, []byte(torrent), 0644))
+
+	return path
+}
+
+// seeder is a fake peer that has the whole torrent
+type seeder struct {
+	listener net.Listener
+	data     []byte
+	torrent  *model.TorrentFile
+
+	// When set, requests are read but never answered
+	silent bool
+
+	// Number of blocks served before hanging up and going away for good, 0 for no limit
+	limit int64
+
+	// Number of blocks served on each connection before hanging up, 0 for no limit
+	drop int64
+
+	served int64
+
+	// Number of blocks sent unasked right after the unchoke
+	unrequested int
+
+	// When set, the first block of every piece is requested from the downloader after the unchoke
+	asks bool
+
+	// When set, blocks past the first held ones are only served once gate is closed
+	gate chan struct{}
+	held int64
+
+	// UNCHOKE and PIECE messages received from the downloader
+	unchokes, pieces int64
+
+	// Peer ID sent in the handshake, made up from the port when empty. Guarded by lock.
+	id string
+
+	// Connections open right now, the most there ever were, and how many were accepted in total
+	open, peak, accepted int64
+
+	lock      sync.Mutex
+	requested []int // Piece index of every request, in order
+}
+
+func newSeeder(t *testing.T, torrent *model.TorrentFile, data []byte) *seeder {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	s := &seeder{listener: listener, data: data, torrent: torrent}
+
+	go s.serve()
+
+	return s
+}
+
+func (s *seeder) peer() model.Peer {
+
+	addr := s.listener.Addr().(*net.TCPAddr)
+
+	return model.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+// requests returns the piece index of every request received so far
+func (s *seeder) requests() []int {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]int(nil), s.requested...)
+}
+
+// serve accepts connections until the listener is closed
+func (s *seeder) serve() {
+
+	for {
+
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *seeder) handle(conn net.Conn) {
+
+	defer conn.Close()
+
+	atomic.AddInt64(&s.accepted, 1)
+
+	open := atomic.AddInt64(&s.open, 1)
+	defer atomic.AddInt64(&s.open, -1)
+
+	for peak := atomic.LoadInt64(&s.peak); open > peak && !atomic.CompareAndSwapInt64(&s.peak, peak, open); {
+		peak = atomic.LoadInt64(&s.peak)
+	}
+
+	servedHere := int64(0)
+
+	var peerID [20]byte
+	copy(peerID[:], fmt.Sprintf("-XX0000-%012d", s.peer().Port))
+
+	s.lock.Lock()
+
+	if s.id != "" {
+		copy(peerID[:], s.id)
+	}
+
+	s.lock.Unlock()
+
+	if _, err := model.ReadHandshake(conn); err != nil {
+		return
+	}
+
+	conn.Write(model.NewHandshake(s.torrent.InfoHash, peerID).Serialize())
+
+	bitfield := model.NewBitfield(len(s.torrent.PieceHashes))
+	bitfield.SetRange(0, len(s.torrent.PieceHashes))
+
+	conn.Write((&model.Message{ID: model.MsgBitfield, Payload: bitfield.Bytes()}).Serialize())
+	conn.Write((&model.Message{ID: model.MsgUnchoke}).Serialize())
+
+	for i := 0; i < s.unrequested; i++ {
+
+		index := len(s.torrent.PieceHashes) - 1 - i%len(s.torrent.PieceHashes)
+		conn.Write(s.block(index, 0, service.MaxBlockSize).Serialize())
+	}
+
+	for index := 0; s.asks && index < len(s.torrent.PieceHashes); index++ {
+		conn.Write(model.MakeRequestMessage(index, 0, service.MaxBlockSize).Serialize())
+	}
+
+	for {
+
+		msg, err := model.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+
+		if msg != nil && msg.ID == model.MsgUnchoke {
+			atomic.AddInt64(&s.unchokes, 1)
+		}
+
+		if msg != nil && msg.ID == model.MsgPiece {
+			atomic.AddInt64(&s.pieces, 1)
+		}
+
+		if msg == nil || msg.ID != model.MsgRequest || s.silent {
+			continue
+		}
+
+		index, begin, length, err := msg.ParseRequest()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		s.requested = append(s.requested, index)
+		s.lock.Unlock()
+
+		if s.gate != nil && atomic.LoadInt64(&s.served) >= s.held {
+			<-s.gate
+		}
+
+		conn.Write(s.block(index, begin, length).Serialize())
+
+		if atomic.AddInt64(&s.served, 1) == s.limit {
+
+			s.listener.Close()
+			return
+		}
+
+		if servedHere++; servedHere == s.drop {
+			return
+		}
+	}
+}
+
+// block makes the PIECE message for a block of data
+func (s *seeder) block(index, begin, length int) *model.Message {
+
+	offset := index*s.torrent.PieceLength + begin
+	payload := make([]byte, 8+length)
+
+	copy(payload, model.MakeHaveMessage(index).Payload)
+	copy(payload[4:], model.MakeHaveMessage(begin).Payload)
+	copy(payload[8:], s.data[offset:offset+length])
+
+	return &model.Message{ID: model.MsgPiece, Payload: payload}
+}
+
+// download runs a download from the given seeders into dir, see writeTorrent for the file lengths
+func download(t *testing.T, dir string, data []byte, configure func(*service.TorrentService, []*seeder), seeders int, lengths ...int) ([]*seeder, error) {
+
+	svc, err := service.NewTorrentService(writeTorrent(t, dir, data, lengths...))
+	assert.Nil(t, err)
+	svc.Config.Encryption = mse.PolicyDisabled
+	svc.Config.PreferUTP = false
+	svc.Config.DownloadDir = dir
+	svc.Config.RetryBackoff = 10 * time.Millisecond
+	svc.Config.ListenAddress = ""
+
+	// Downloads whose peers went away fail soon instead of asking the tracker
+	svc.Config.PeerSource = func() ([]model.Peer, error) { return nil, nil }
+	svc.Config.StallTimeout = 200 * time.Millisecond
+	svc.Config.GiveUpTimeout = time.Second
+
+	var swarm []*seeder
+
+	for i := 0; i < seeders; i++ {
+
+		s := newSeeder(t, svc.Torrent, data)
+		defer s.listener.Close()
+
+		swarm = append(swarm, s)
+	}
+
+	if configure != nil {
+		configure(svc, swarm)
+	}
+
+	ch := make(chan *model.Client)
+
+	for _, s := range swarm {
+		go model.NewClient(s.peer(), svc.Torrent.InfoHash, len(svc.Torrent.PieceHashes), svc.PeerID, svc.ConnectionOptions(), ch)
+	}
+
+	for range swarm {
+
+		client := <-ch
+		assert.NotNil(t, client)
+
+		svc.Clients = append(svc.Clients, client)
+	}
+
+	defer svc.CloseConnections()
+
+	done := make(chan error, 1)
+	go func() { done <- svc.Download() }()
+
+	select {
+
+	case err := <-done:
+		return swarm, err
+
+	case <-time.After(20 * time.Second):
+		t.Fatal("download did not finish")
+	}
+
+	return swarm, nil
+}
+
+func readContent(t *testing.T, dir string) []byte {
+
+	written, err := os.ReadFile(filepath.Join(dir, "content.bin"))
+	assert.Nil(t, err)
+
+	return written
+}
+
+func randomData(t *testing.T, n int) []byte {
+
+	data := make([]byte, n)
+
+	_, err := rand.Read(data)
+	assert.Nil(t, err)
+
+	return data
+}
+
+func TestDownloadFromSeveralPeers(t *testing.T) {
+
+	data := randomData(t, 16*testPieceLength)
+
+	dir := t.TempDir()
+	swarm, err := download(t, dir, data, nil, 3)
+	assert.Nil(t, err)
+
+	assert.Equal(t, data, readContent(t, dir))
+
+	for _, s := range swarm {
+		assert.Greater(t, atomic.LoadInt64(&s.served), int64(0))
+	}
+}
+
+func TestDownloadRejectsDuplicatePeerID(t *testing.T) {
+
+	data := randomData(t, 8*testPieceLength)
+	dir := t.TempDir()
+
+	swarm, err := download(t, dir, data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		for _, s := range swarm {
+
+			s.lock.Lock()
+			s.id = "-XX0000-samepeeridxx"
+			s.lock.Unlock()
+		}
+
+	}, 2)
+
+	assert.Nil(t, err)
+	assert.Equal(t, data, readContent(t, dir))
+
+	// The second connection to the same client was closed before it was asked for anything
+	served := []int64{atomic.LoadInt64(&swarm[0].served), atomic.LoadInt64(&swarm[1].served)}
+
+	assert.Contains(t, served, int64(0))
+	assert.Contains(t, served, int64(len(data)/service.MaxBlockSize))
+}
+
+func TestDownloadIgnoresRequestsFromPeers(t *testing.T) {
+
+	data := randomData(t, 8*testPieceLength)
+	dir := t.TempDir()
+
+	swarm, err := download(t, dir, data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		swarm[0].asks = true
+
+	}, 1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, data, readContent(t, dir))
+
+	// We do not upload, so the peer stays choked and gets nothing
+	assert.Equal(t, int64(0), atomic.LoadInt64(&swarm[0].unchokes))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&swarm[0].pieces))
+}
+
+func TestDownloadReassignsTimedOutBlocks(t *testing.T) {
+
+	data := randomData(t, 8*testPieceLength)
+
+	dir := t.TempDir()
+
+	_, err := download(t, dir, data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		svc.Config.RequestTimeout = 100 * time.Millisecond
+		swarm[0].silent = true
+
+	}, 2)
+
+	assert.Nil(t, err)
+
+	assert.Equal(t, data, readContent(t, dir))
+}
+
+func TestDownloadShortFinalPiece(t *testing.T) {
+
+	data := randomData(t, 5*testPieceLength+service.MaxBlockSize+123)
+
+	dir := t.TempDir()
+	_, err := download(t, dir, data, nil, 2)
+	assert.Nil(t, err)
+
+	assert.Equal(t, data, readContent(t, dir))
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+
+	data := randomData(t, 16*testPieceLength)
+
+	dir := t.TempDir()
+	start := time.Now()
+
+	_, err := download(t, dir, data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		svc.Config.DownloadLimit = 256 << 10
+
+	}, 2)
+
+	assert.Nil(t, err)
+	assert.Equal(t, data, readContent(t, dir))
+
+	// 512 KiB with 64 KiB of burst
+	assert.Greater(t, time.Since(start), 1500*time.Millisecond)
+}
+
+func TestDownloadIntoMemory(t *testing.T) {
+
+	data := randomData(t, 3*testPieceLength)
+
+	var store *storage.MemoryStorage
+
+	_, err := download(t, t.TempDir(), data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		svc.Config.Storage = func(torrent *model.TorrentFile) (storage.Storage, error) {
+
+			store = storage.NewMemoryStorage(torrent)
+			return store, nil
+		}
+
+	}, 1)
+
+	assert.Nil(t, err)
+
+	assert.Equal(t, data, store.Bytes())
+	completion := store.Completion()
+	assert.Equal(t, []int{0, 1, 2}, completion.Pieces())
+}
+
+// firstWrite opens a gate on the first write, noting how many blocks the seeder had served by then
+type firstWrite struct {
+	*storage.MemoryStorage
+
+	once   sync.Once
+	seeder *seeder
+	served int64
+}
+
+func (w *firstWrite) WriteAt(p []byte, index, begin int) (int, error) {
+
+	w.once.Do(func() {
+
+		w.served = atomic.LoadInt64(&w.seeder.served)
+		close(w.seeder.gate)
+	})
+
+	return w.MemoryStorage.WriteAt(p, index, begin)
+}
+
+func TestDownloadWritesPiecesAsTheyAreVerified(t *testing.T) {
+
+	data := randomData(t, 8*testPieceLength)
+	blocks := int64(len(data) / service.MaxBlockSize)
+
+	var store *firstWrite
+
+	_, err := download(t, t.TempDir(), data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		// The rest of the data only comes once the first two pieces are in the storage, which a
+		// download holding every piece in memory until the end would never get to
+		swarm[0].gate = make(chan struct{})
+		swarm[0].held = 2 * testPieceLength / service.MaxBlockSize
+
+		svc.Config.Storage = func(torrent *model.TorrentFile) (storage.Storage, error) {
+
+			store = &firstWrite{MemoryStorage: storage.NewMemoryStorage(torrent), seeder: swarm[0]}
+			return store, nil
+		}
+
+	}, 1)
+
+	assert.Nil(t, err)
+
+	assert.Equal(t, data, store.Bytes())
+	assert.Less(t, store.served, blocks)
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/mse"
+	"example/bittorrent_in_go/service"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const listenPieceLength = 2 * service.MaxBlockSize
+
+// writeListenTorrent creates a .torrent describing data as a single file named content.bin
+func writeListenTorrent(t *testing.T, dir string, data []byte) string {
+
+	var pieces strings.Builder
+
+	for begin := 0; begin < len(data); begin += listenPieceLength {
+
+		hash := sha1.Sum(data[begin : begin+listenPieceLength])
+		pieces.Write(hash[:])
+	}
+
+	info := fmt.Sprintf("d6:lengthi%de4:name11:content.bin12:piece lengthi%de6:pieces%d:%se",
+		len(data), listenPieceLength, pieces.Len(), pieces.String())
+
+	torrent := "d8:announce17:http://localhost/4:info" + info + "e"
+	path := filepath.Join(dir, "content.torrent")
+
+	assert.Nil(t, os.WriteFile(path, []byte(torrent), 0644))
+
+	return path
+}
+
+// seedTo connects to a downloader, encrypted, and serves it every block it asks for
+func seedTo(address string, torrent *model.TorrentFile, data []byte) error {
+
+	conn, err := net.Dial("tcp", address)
+
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	wrapped, err := mse.Initiate(conn, torrent.InfoHash, mse.CryptoRC4)
+
+	if err != nil {
+		return err
+	}
+
+	var id [20]byte
+	copy(id[:], "-SD0000-connectstous")
+
+	if _, err = wrapped.Write(model.NewHandshake(torrent.InfoHash, id).Serialize()); err != nil {
+		return err
+	}
+
+	if _, err = model.ReadHandshake(wrapped); err != nil {
+		return err
+	}
+
+	bitfield := make([]byte, (len(torrent.PieceHashes)+7)/8)
+
+	for i := range torrent.PieceHashes {
+		bitfield[i/8] |= 1 << (7 - uint(i%8))
+	}
+
+	wrapped.Write((&model.Message{ID: model.MsgBitfield, Payload: bitfield}).Serialize())
+	wrapped.Write((&model.Message{ID: model.MsgUnchoke}).Serialize())
+
+	for {
+
+		msg, err := model.ReadMessage(wrapped)
+
+		if err != nil {
+			return nil // The download is over
+		}
+
+		if msg == nil || msg.ID != model.MsgRequest {
+			continue
+		}
+
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+
+		offset := index*torrent.PieceLength + begin
+
+		payload := make([]byte, 8+length)
+		binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+		binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+		copy(payload[8:], data[offset:offset+length])
+
+		if _, err = wrapped.Write((&model.Message{ID: model.MsgPiece, Payload: payload}).Serialize()); err != nil {
+			return err
+		}
+	}
+}
+
+func TestDownloadFromPeerThatConnectsToUs(t *testing.T) {
+
+	data := make([]byte, 4*listenPieceLength)
+	_, err := rand.Read(data)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+
+	svc, err := service.NewTorrentService(writeListenTorrent(t, dir, data))
+	assert.Nil(t, err)
+
+	svc.Config.ListenAddress = "127.0.0.1:0"
+	svc.Config.Encryption = mse.PolicyRequire
+	svc.Config.DownloadDir = dir
+	svc.Config.PeerSource = func() ([]model.Peer, error) { return nil, nil }
+
+	done := make(chan error, 1)
+	go func() { done <- svc.Download() }()
+
+	// Nobody to dial, the seeder finds us once the download listens
+	for svc.ListenPort() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	go seedTo(net.JoinHostPort("127.0.0.1", strconv.Itoa(svc.ListenPort())), svc.Torrent, data)
+
+	select {
+
+	case err := <-done:
+		assert.Nil(t, err)
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+
+	svc.CloseConnections()
+
+	content, err := os.ReadFile(filepath.Join(dir, "content.bin"))
+	assert.Nil(t, err)
+	assert.Equal(t, data, content)
+}
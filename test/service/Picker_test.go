@@ -0,0 +1,95 @@
+package test
+
+import (
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/service"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func candidates(n int, indexes ...int) model.Bitfield {
+
+	bf := model.NewBitfield(n)
+
+	for _, index := range indexes {
+		bf.MarkPiece(index)
+	}
+
+	return bf
+}
+
+func TestRarestFirstPicksRarest(t *testing.T) {
+
+	picker := service.NewRarestFirstPicker(0)
+
+	ctx := &service.PickContext{
+
+		Candidates:   candidates(8, 1, 3, 5),
+		Availability: []int{1, 4, 9, 2, 0, 3, 7, 7},
+	}
+
+	assert.Equal(t, 3, picker.Pick(ctx))
+
+	// Piece 4 is rarer but not a candidate
+	ctx.Candidates = candidates(8, 1, 5)
+	assert.Equal(t, 5, picker.Pick(ctx))
+}
+
+func TestRarestFirstBreaksTiesRandomly(t *testing.T) {
+
+	picker := service.NewRarestFirstPicker(0)
+
+	ctx := &service.PickContext{
+
+		Candidates:   candidates(4, 0, 1, 2, 3),
+		Availability: []int{2, 1, 1, 3},
+	}
+
+	picked := map[int]bool{}
+
+	for i := 0; i < 200; i++ {
+		picked[picker.Pick(ctx)] = true
+	}
+
+	assert.Equal(t, map[int]bool{1: true, 2: true}, picked)
+}
+
+func TestRandomFirstIgnoresAvailability(t *testing.T) {
+
+	picker := service.NewRarestFirstPicker(2)
+
+	ctx := &service.PickContext{
+
+		Candidates:   candidates(4, 0, 1, 2, 3),
+		Availability: []int{0, 5, 5, 5},
+		Completed:    1,
+	}
+
+	picked := map[int]bool{}
+
+	for i := 0; i < 200; i++ {
+		picked[picker.Pick(ctx)] = true
+	}
+
+	assert.Len(t, picked, 4)
+
+	ctx.Completed = 2
+	assert.Equal(t, 0, picker.Pick(ctx))
+}
+
+func TestPickersWithoutCandidates(t *testing.T) {
+
+	ctx := &service.PickContext{Candidates: model.NewBitfield(10), Availability: make([]int, 10)}
+
+	assert.Equal(t, -1, service.NewRarestFirstPicker(0).Pick(ctx))
+	assert.Equal(t, -1, service.NewRarestFirstPicker(4).Pick(ctx))
+	assert.Equal(t, -1, service.SequentialPicker{}.Pick(ctx))
+}
+
+func TestSequentialPicker(t *testing.T) {
+
+	ctx := &service.PickContext{Candidates: candidates(20, 11, 13, 19), Availability: make([]int, 20)}
+
+	assert.Equal(t, 11, service.SequentialPicker{}.Pick(ctx))
+}
@@ -0,0 +1,42 @@
+package test
+
+import (
+	"example/bittorrent_in_go/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBacklogDepth(t *testing.T) {
+
+	const block = service.MaxBlockSize
+
+	tests := []struct {
+		name  string
+		rate  float64
+		rtt   time.Duration
+		reqq  int
+		depth int
+	}{
+		{"nothing measured", 0, 0, 0, service.MinBacklog},
+		{"slow peer", block / 4, 100 * time.Millisecond, 0, service.MinBacklog},
+		{"one second of blocks", 10 * block, 0, 0, 10},
+		{"round trip adds to it", 10 * block, time.Second, 0, 20},
+		{"faster peer gets more", 40 * block, 500 * time.Millisecond, 0, 60},
+		{"slower peer gets less", 4 * block, 500 * time.Millisecond, 0, 6},
+		{"partial blocks round up", 10.5 * block, 0, 0, 11},
+		{"capped by reqq", 40 * block, 500 * time.Millisecond, 25, 25},
+		{"reqq above the need", 40 * block, 500 * time.Millisecond, 250, 60},
+		{"reqq wins over the minimum", block, 0, 1, 1},
+		{"capped by MaxBacklog", 1e4 * block, time.Second, 0, service.MaxBacklog},
+		{"reqq above MaxBacklog", 1e4 * block, time.Second, 10 * service.MaxBacklog, service.MaxBacklog},
+	}
+
+	for _, test := range tests {
+
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.depth, service.BacklogDepth(test.rate, test.rtt, test.reqq))
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"example/bittorrent_in_go/service"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Three files over six pieces: f0 in pieces 0-1, f1 in pieces 1-4, f2 in pieces 4-5
+var priorityLengths = []int{testPieceLength + testPieceLength/2, 3 * testPieceLength, testPieceLength + testPieceLength/2}
+
+func TestSkippedFilesAreNotDownloaded(t *testing.T) {
+
+	data := randomData(t, 6*testPieceLength)
+	dir := t.TempDir()
+
+	swarm, err := download(t, dir, data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		assert.Nil(t, svc.SetFilePriority(1, service.PrioritySkip))
+
+	}, 1, priorityLengths...)
+
+	assert.Nil(t, err)
+
+	for _, index := range swarm[0].requests() {
+		assert.Contains(t, []int{0, 1, 4, 5}, index)
+	}
+
+	f0, err := os.ReadFile(filepath.Join(dir, "content", "f0"))
+	assert.Nil(t, err)
+	assert.Equal(t, data[:priorityLengths[0]], f0)
+
+	f2, err := os.ReadFile(filepath.Join(dir, "content", "f2"))
+	assert.Nil(t, err)
+	assert.Equal(t, data[len(data)-priorityLengths[2]:], f2)
+
+	_, err = os.Stat(filepath.Join(dir, "content", "f1"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHighPriorityFilesComeFirst(t *testing.T) {
+
+	data := randomData(t, 6*testPieceLength)
+
+	swarm, err := download(t, t.TempDir(), data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		svc.Config.Picker = service.SequentialPicker{}
+
+		assert.Nil(t, svc.SetFilePriority(2, service.PriorityHigh))
+		assert.Nil(t, svc.SetFilePriority(0, service.PriorityLow))
+
+		assert.Equal(t, []service.FilePriority{service.PriorityLow, service.PriorityNormal, service.PriorityHigh}, svc.FilePriorities())
+
+	}, 1, priorityLengths...)
+
+	assert.Nil(t, err)
+
+	// f2's pieces, then f1's, and f0's only piece that is not shared with f1 last
+	requests := swarm[0].requests()
+
+	assert.Equal(t, 4, requests[0])
+	assert.Equal(t, 0, requests[len(requests)-1])
+}
+
+func TestSetFilePriorityValidates(t *testing.T) {
+
+	svc, err := service.NewTorrentService(writeTorrent(t, t.TempDir(), randomData(t, testPieceLength)))
+	assert.Nil(t, err)
+
+	assert.NotNil(t, svc.SetFilePriority(1, service.PriorityHigh))
+	assert.NotNil(t, svc.SetFilePriority(0, service.FilePriority(7)))
+	assert.Nil(t, svc.SetFilePriority(0, service.PrioritySkip))
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"example/bittorrent_in_go/service"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeSkipsCompletedDownload(t *testing.T) {
+
+	data := randomData(t, 4*testPieceLength)
+	dir := t.TempDir()
+
+	_, err := download(t, dir, data, nil, 1)
+	assert.Nil(t, err)
+
+	// Nothing is left to download, so no peers are needed
+	_, err = download(t, dir, data, nil, 0)
+	assert.Nil(t, err)
+
+	assert.Equal(t, data, readContent(t, dir))
+}
+
+func TestResumeKeepsPartialBlocks(t *testing.T) {
+
+	data := randomData(t, 4*testPieceLength)
+	dir := t.TempDir()
+
+	swarm, err := download(t, dir, data, func(_ *service.TorrentService, swarm []*seeder) {
+		swarm[0].limit = 3
+	}, 1)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&swarm[0].served))
+
+	swarm, err = download(t, dir, data, nil, 1)
+	assert.Nil(t, err)
+
+	// Only the blocks the first run did not get are requested again
+	blocks := int64(len(data) / service.MaxBlockSize)
+	assert.Equal(t, blocks-3, atomic.LoadInt64(&swarm[0].served))
+
+	assert.Equal(t, data, readContent(t, dir))
+}
+
+func TestResumeRechecksModifiedFiles(t *testing.T) {
+
+	data := randomData(t, 4*testPieceLength)
+	dir := t.TempDir()
+
+	_, err := download(t, dir, data, nil, 1)
+	assert.Nil(t, err)
+
+	// Damage the second piece behind the resume file's back
+	path := filepath.Join(dir, "content.bin")
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+
+	_, err = file.WriteAt([]byte{^data[testPieceLength]}, testPieceLength)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(path, later, later))
+
+	swarm, err := download(t, dir, data, nil, 1)
+	assert.Nil(t, err)
+
+	// The damaged piece is downloaded again, the others pass the re-check
+	assert.Equal(t, int64(testPieceLength/service.MaxBlockSize), atomic.LoadInt64(&swarm[0].served))
+	assert.Equal(t, data, readContent(t, dir))
+}
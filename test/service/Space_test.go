@@ -0,0 +1,56 @@
+package test
+
+import (
+	"errors"
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/service"
+	"example/bittorrent_in_go/storage"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fullDisk fails every write like a file system without space left
+type fullDisk struct {
+	*storage.MemoryStorage
+}
+
+func (fullDisk) WriteAt(p []byte, index, begin int) (int, error) {
+
+	return 0, syscall.ENOSPC
+}
+
+func TestDownloadStopsOnFullDisk(t *testing.T) {
+
+	data := randomData(t, 3*testPieceLength)
+
+	_, err := download(t, t.TempDir(), data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		svc.Config.Storage = func(torrent *model.TorrentFile) (storage.Storage, error) {
+
+			return fullDisk{storage.NewMemoryStorage(torrent)}, nil
+		}
+
+	}, 1)
+
+	assert.True(t, errors.Is(err, service.ErrDiskFull))
+}
+
+func TestDownloadRefusesWithoutFreeSpace(t *testing.T) {
+
+	dir := t.TempDir()
+
+	svc, err := service.NewTorrentService(writeTorrent(t, dir, randomData(t, testPieceLength)))
+	assert.Nil(t, err)
+	svc.Config.DownloadDir = dir
+
+	// Pretend the single piece is far larger than any disk
+	svc.Torrent.PieceLength = 1 << 60
+	svc.Torrent.Length = 1 << 60
+	svc.Torrent.Files[0].Length = 1 << 60
+
+	err = svc.Download()
+
+	assert.True(t, errors.Is(err, service.ErrDiskFull))
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"errors"
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/service"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadGivesUpWithoutPeers(t *testing.T) {
+
+	data := randomData(t, 2*testPieceLength)
+
+	var asked int32
+	start := time.Now()
+
+	_, err := download(t, t.TempDir(), data, func(svc *service.TorrentService, _ []*seeder) {
+
+		// Leaves the first check of the download time to ask before giving up
+		svc.Config.GiveUpTimeout = 2 * time.Second
+
+		svc.Config.PeerSource = func() ([]model.Peer, error) {
+
+			atomic.AddInt32(&asked, 1)
+			return nil, nil
+		}
+
+	}, 0)
+
+	assert.True(t, errors.Is(err, service.ErrStalled))
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Having no peers at all is a stall worth asking for more right away
+	assert.Greater(t, atomic.LoadInt32(&asked), int32(0))
+}
+
+func TestDownloadGivesUpWhenPeersSendNothing(t *testing.T) {
+
+	data := randomData(t, 2*testPieceLength)
+
+	_, err := download(t, t.TempDir(), data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		swarm[0].silent = true
+		svc.Config.RequestTimeout = time.Minute
+
+	}, 1)
+
+	assert.True(t, errors.Is(err, service.ErrStalled))
+}
+
+func TestDownloadFindsPeersWhenStalled(t *testing.T) {
+
+	data := randomData(t, 4*testPieceLength)
+	dir := t.TempDir()
+
+	var asked int32
+
+	_, err := download(t, dir, data, func(svc *service.TorrentService, _ []*seeder) {
+
+		s := newSeeder(t, svc.Torrent, data)
+		t.Cleanup(func() { s.listener.Close() })
+
+		svc.Config.GiveUpTimeout = 10 * time.Second
+
+		// The seeder only shows up on the second announce
+		svc.Config.PeerSource = func() ([]model.Peer, error) {
+
+			if atomic.AddInt32(&asked, 1) < 2 {
+				return nil, nil
+			}
+
+			return []model.Peer{s.peer()}, nil
+		}
+
+	}, 0)
+
+	assert.Nil(t, err)
+	assert.Equal(t, data, readContent(t, dir))
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&asked), int32(2))
+}
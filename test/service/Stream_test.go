@@ -0,0 +1,116 @@
+package test
+
+import (
+	"example/bittorrent_in_go/service"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaderStreamsWhileDownloading(t *testing.T) {
+
+	data := randomData(t, 6*testPieceLength+100)
+
+	var got []byte
+	var readErr error
+
+	read := make(chan struct{})
+
+	_, err := download(t, t.TempDir(), data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		reader, err := svc.NewReader(0)
+		assert.Nil(t, err)
+
+		go func() {
+
+			defer close(read)
+			defer reader.Close()
+
+			got, readErr = io.ReadAll(reader)
+		}()
+
+	}, 2)
+
+	assert.Nil(t, err)
+
+	<-read
+
+	assert.Nil(t, readErr)
+	assert.Equal(t, data, got)
+}
+
+func TestReaderPrioritizesReadPosition(t *testing.T) {
+
+	data := randomData(t, 8*testPieceLength)
+
+	swarm, err := download(t, t.TempDir(), data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		// Without a reader pieces would be fetched in order
+		svc.Config.Picker = service.SequentialPicker{}
+
+		reader, err := svc.NewReader(0)
+		assert.Nil(t, err)
+
+		_, err = reader.Seek(-10, io.SeekEnd)
+		assert.Nil(t, err)
+
+		reader.SetReadahead(0)
+
+		go func() {
+
+			defer reader.Close()
+
+			io.Copy(io.Discard, reader)
+		}()
+
+	}, 1)
+
+	assert.Nil(t, err)
+
+	assert.Equal(t, 7, swarm[0].requests()[0])
+}
+
+func TestReaderRejectsUnknownFile(t *testing.T) {
+
+	svc, err := service.NewTorrentService(writeTorrent(t, t.TempDir(), randomData(t, testPieceLength)))
+	assert.Nil(t, err)
+
+	_, err = svc.NewReader(1)
+	assert.NotNil(t, err)
+}
+
+func TestReaderFailsWhenDownloadStops(t *testing.T) {
+
+	data := randomData(t, 4*testPieceLength)
+	dir := t.TempDir()
+
+	var readErr error
+	read := make(chan struct{})
+
+	_, err := download(t, dir, data, func(svc *service.TorrentService, swarm []*seeder) {
+
+		swarm[0].limit = 1
+
+		reader, err := svc.NewReader(0)
+		assert.Nil(t, err)
+
+		_, err = reader.Seek(3*testPieceLength, io.SeekStart)
+		assert.Nil(t, err)
+
+		go func() {
+
+			defer close(read)
+			defer reader.Close()
+
+			_, readErr = reader.Read(make([]byte, 10))
+		}()
+
+	}, 1)
+
+	assert.NotNil(t, err)
+
+	<-read
+
+	assert.NotNil(t, readErr)
+}
@@ -0,0 +1,61 @@
+package test
+
+import (
+	"example/bittorrent_in_go/service"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyIntactData(t *testing.T) {
+
+	data := randomData(t, 4*testPieceLength+100)
+
+	dir := t.TempDir()
+	svc, err := service.NewTorrentService(writeTorrent(t, dir, data))
+	assert.Nil(t, err)
+	svc.Config.DownloadDir = dir
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "content.bin"), data, 0644))
+
+	result, err := svc.Verify()
+	assert.Nil(t, err)
+
+	assert.True(t, result.OK())
+	assert.Equal(t, 5, result.Pieces)
+	assert.Equal(t, 100.0, result.Percent())
+}
+
+func TestVerifyReportsBadPiecesAndFiles(t *testing.T) {
+
+	data := randomData(t, 4*testPieceLength)
+
+	dir := t.TempDir()
+	svc, err := service.NewTorrentService(writeTorrent(t, dir, data, testPieceLength, 2*testPieceLength, testPieceLength))
+	assert.Nil(t, err)
+	svc.Config.DownloadDir = dir
+
+	content := filepath.Join(dir, "content")
+	assert.Nil(t, os.MkdirAll(content, 0755))
+
+	// f1 is corrupted in its second piece, f2 is missing
+	corrupt := append([]byte(nil), data[testPieceLength:3*testPieceLength]...)
+	corrupt[testPieceLength+5] ^= 0xff
+
+	assert.Nil(t, os.WriteFile(filepath.Join(content, "f0"), data[:testPieceLength], 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(content, "f1"), corrupt, 0644))
+
+	result, err := svc.Verify()
+	assert.Nil(t, err)
+
+	assert.False(t, result.OK())
+	assert.Equal(t, []int{2, 3}, result.BadPieces)
+	assert.Equal(t, []string{filepath.Join("content", "f1"), filepath.Join("content", "f2")}, result.BadFiles)
+	assert.Equal(t, 50.0, result.Percent())
+
+	// Verifying leaves the disk alone
+	_, err = os.Stat(filepath.Join(content, "f2"))
+	assert.True(t, os.IsNotExist(err))
+}
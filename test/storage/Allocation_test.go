@@ -0,0 +1,60 @@
+package test
+
+import (
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/storage"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocationModes(t *testing.T) {
+
+	const size = 1 << 20
+
+	torrent := &model.TorrentFile{Name: "content.bin", PieceLength: 1 << 18, Length: size}
+
+	for _, allocation := range []storage.Allocation{storage.AllocateSparse, storage.AllocateFull, storage.AllocateNone} {
+
+		t.Run(allocation.String(), func(t *testing.T) {
+
+			dir := t.TempDir()
+
+			store, err := storage.NewFileStorage(torrent, dir, allocation)
+			assert.Nil(t, err)
+
+			_, err = store.WriteAt([]byte("data"), 1, 0)
+			assert.Nil(t, err)
+			assert.Nil(t, store.Close())
+
+			path := filepath.Join(dir, "content.bin")
+
+			info, err := os.Stat(path)
+			assert.Nil(t, err)
+
+			switch allocation {
+
+			case storage.AllocateSparse:
+				assert.Equal(t, int64(size), info.Size())
+				assert.Less(t, storage.AllocatedSize(path), int64(size))
+
+			case storage.AllocateFull:
+				assert.Equal(t, int64(size), info.Size())
+				assert.GreaterOrEqual(t, storage.AllocatedSize(path), int64(size))
+
+			case storage.AllocateNone:
+				assert.Equal(t, int64(1<<18+4), info.Size())
+			}
+		})
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+
+	free, err := storage.FreeSpace(filepath.Join(t.TempDir(), "not", "created", "yet"))
+
+	assert.Nil(t, err)
+	assert.Greater(t, free, int64(0))
+}
@@ -0,0 +1,264 @@
+package test
+
+import (
+	"errors"
+	"example/bittorrent_in_go/model"
+	"example/bittorrent_in_go/storage"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTorrent() *model.TorrentFile {
+
+	return &model.TorrentFile{Name: "content.bin", PieceLength: 16, Length: 40}
+}
+
+func backends(dir string) map[string]storage.Opener {
+
+	return map[string]storage.Opener{
+
+		"file":   storage.FileOpener(filepath.Join(dir, "file"), storage.AllocateSparse),
+		"mmap":   storage.MmapOpener(filepath.Join(dir, "mmap"), storage.AllocateSparse),
+		"memory": storage.MemoryOpener,
+	}
+}
+
+func TestStorageReadWrite(t *testing.T) {
+
+	for name, open := range backends(t.TempDir()) {
+
+		t.Run(name, func(t *testing.T) {
+
+			store, err := open(testTorrent())
+			assert.Nil(t, err)
+			defer store.Close()
+
+			n, err := store.WriteAt([]byte("last pie"), 2, 0)
+			assert.Nil(t, err)
+			assert.Equal(t, 8, n)
+
+			n, err = store.WriteAt([]byte("abcd"), 1, 12)
+			assert.Nil(t, err)
+			assert.Equal(t, 4, n)
+
+			buf := make([]byte, 4)
+			_, err = store.ReadAt(buf, 1, 12)
+			assert.Nil(t, err)
+			assert.Equal(t, "abcd", string(buf))
+
+			buf = make([]byte, 8)
+			_, err = store.ReadAt(buf, 2, 0)
+			assert.Nil(t, err)
+			assert.Equal(t, "last pie", string(buf))
+
+			assert.Nil(t, store.Flush())
+		})
+	}
+}
+
+func TestStorageOutOfRange(t *testing.T) {
+
+	for name, open := range backends(t.TempDir()) {
+
+		t.Run(name, func(t *testing.T) {
+
+			store, err := open(testTorrent())
+			assert.Nil(t, err)
+			defer store.Close()
+
+			// The final piece is only 8 bytes long
+			_, err = store.WriteAt(make([]byte, 9), 2, 0)
+			assert.True(t, errors.Is(err, storage.ErrOutOfRange))
+
+			_, err = store.ReadAt(make([]byte, 1), 3, 0)
+			assert.True(t, errors.Is(err, storage.ErrOutOfRange))
+
+			_, err = store.ReadAt(make([]byte, 1), 0, -1)
+			assert.True(t, errors.Is(err, storage.ErrOutOfRange))
+		})
+	}
+}
+
+func TestStorageCompletion(t *testing.T) {
+
+	for name, open := range backends(t.TempDir()) {
+
+		t.Run(name, func(t *testing.T) {
+
+			store, err := open(testTorrent())
+			assert.Nil(t, err)
+			defer store.Close()
+
+			assert.Nil(t, store.MarkComplete(2))
+			assert.NotNil(t, store.MarkComplete(3))
+
+			completion := store.Completion()
+			assert.Equal(t, []int{2}, completion.Pieces())
+		})
+	}
+}
+
+func TestFileStorageKeepsExistingData(t *testing.T) {
+
+	dir := t.TempDir()
+
+	for _, open := range []storage.Opener{storage.FileOpener(dir, storage.AllocateSparse), storage.MmapOpener(dir, storage.AllocateSparse)} {
+
+		store, err := open(testTorrent())
+		assert.Nil(t, err)
+
+		buf := make([]byte, 4)
+		_, err = store.ReadAt(buf, 0, 0)
+		assert.Nil(t, err)
+
+		_, err = store.WriteAt([]byte("keep"), 0, 0)
+		assert.Nil(t, err)
+		assert.Nil(t, store.Close())
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "content.bin"))
+	assert.Nil(t, err)
+	assert.Equal(t, 40, len(data))
+	assert.Equal(t, "keep", string(data[:4]))
+}
+
+func multiFileTorrent() *model.TorrentFile {
+
+	return &model.TorrentFile{
+
+		Name:        "root",
+		PieceLength: 16,
+		Length:      40,
+		Files: []model.FileEntry{
+
+			{Path: filepath.Join("root", "a"), Length: 10, Offset: 0},
+			{Path: filepath.Join("root", "b"), Length: 20, Offset: 10},
+			{Path: filepath.Join("root", "c"), Length: 10, Offset: 30},
+		},
+	}
+}
+
+func TestStorageSpansFiles(t *testing.T) {
+
+	dir := t.TempDir()
+
+	for _, open := range []storage.Opener{storage.FileOpener(filepath.Join(dir, "file"), storage.AllocateSparse), storage.MmapOpener(filepath.Join(dir, "mmap"), storage.AllocateSparse)} {
+
+		store, err := open(multiFileTorrent())
+		assert.Nil(t, err)
+
+		// Piece 0 covers all of a and the start of b, piece 1 the rest of b and the start of c
+		_, err = store.WriteAt([]byte("0123456789ABCDEF"), 0, 0)
+		assert.Nil(t, err)
+
+		_, err = store.WriteAt([]byte("GHIJKLMNOPQRSTUV"), 1, 0)
+		assert.Nil(t, err)
+
+		buf := make([]byte, 8)
+		_, err = store.ReadAt(buf, 0, 8)
+		assert.Nil(t, err)
+		assert.Equal(t, "89ABCDEF", string(buf))
+
+		assert.Nil(t, store.Close())
+	}
+
+	for _, backend := range []string{"file", "mmap"} {
+
+		a, _ := os.ReadFile(filepath.Join(dir, backend, "root", "a"))
+		b, _ := os.ReadFile(filepath.Join(dir, backend, "root", "b"))
+		c, _ := os.ReadFile(filepath.Join(dir, backend, "root", "c"))
+
+		assert.Equal(t, "0123456789", string(a))
+		assert.Equal(t, "ABCDEFGHIJKLMNOPQRST", string(b))
+		assert.Equal(t, "UV\x00\x00\x00\x00\x00\x00\x00\x00", string(c))
+	}
+}
+
+func TestStorageSkippedFiles(t *testing.T) {
+
+	dir := t.TempDir()
+
+	store, err := storage.NewFileStorage(multiFileTorrent(), dir, storage.AllocateSparse)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	assert.Nil(t, store.SetSkipped(0, true))
+
+	// Piece 0 is shared between the skipped file a and the wanted file b
+	_, err = store.WriteAt([]byte("0123456789ABCDEF"), 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Flush())
+
+	_, err = os.Stat(filepath.Join(dir, "root", "a"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The whole piece still reads back for verification
+	buf := make([]byte, 16)
+	_, err = store.ReadAt(buf, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789ABCDEF", string(buf))
+
+	// Wanting the file again creates it from the part file
+	assert.Nil(t, store.SetSkipped(0, false))
+
+	a, err := os.ReadFile(filepath.Join(dir, "root", "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789", string(a))
+}
+
+func TestStoragePaddingAndAttributes(t *testing.T) {
+
+	torrent := &model.TorrentFile{Name: "root", PieceLength: 16, Length: 32, Files: []model.FileEntry{
+
+		{Path: filepath.Join("root", "run.sh"), Length: 10, Offset: 0, Attr: "x"},
+		{Path: filepath.Join("root", ".pad", "6"), Length: 6, Offset: 10, Attr: "p"},
+		{Path: filepath.Join("root", "data"), Length: 16, Offset: 16},
+		{Path: filepath.Join("root", "sub", "link"), Offset: 32, Attr: "l", Symlink: filepath.Join("root", "run.sh")},
+	}}
+
+	dir := t.TempDir()
+
+	for _, open := range []storage.Opener{storage.FileOpener(filepath.Join(dir, "file"), storage.AllocateSparse), storage.MmapOpener(filepath.Join(dir, "mmap"), storage.AllocateSparse)} {
+
+		store, err := open(torrent)
+		assert.Nil(t, err)
+
+		_, err = store.WriteAt([]byte("#!/bin/sh\nxxxxxx"), 0, 0)
+		assert.Nil(t, err)
+
+		_, err = store.WriteAt([]byte("0123456789abcdef"), 1, 0)
+		assert.Nil(t, err)
+
+		// Padding reads as zeros whatever was written there
+		buf := make([]byte, 16)
+		_, err = store.ReadAt(buf, 0, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, append([]byte("#!/bin/sh\n"), make([]byte, 6)...), buf)
+
+		assert.Nil(t, store.Flush())
+		assert.Nil(t, store.Close())
+	}
+
+	for _, backend := range []string{"file", "mmap"} {
+
+		root := filepath.Join(dir, backend, "root")
+
+		_, err := os.Stat(filepath.Join(root, ".pad"))
+		assert.True(t, os.IsNotExist(err))
+
+		info, err := os.Stat(filepath.Join(root, "run.sh"))
+		assert.Nil(t, err)
+		assert.NotZero(t, info.Mode()&0100)
+
+		target, err := os.Readlink(filepath.Join(root, "sub", "link"))
+		assert.Nil(t, err)
+		assert.Equal(t, filepath.Join("..", "run.sh"), target)
+
+		data, err := os.ReadFile(filepath.Join(root, "sub", "link"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("#!/bin/sh\n"), data)
+	}
+}
@@ -0,0 +1,118 @@
+package test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"example/bittorrent_in_go/utp"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransfer(t *testing.T) {
+
+	socket, err := utp.Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer socket.Close()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	received := make(chan []byte, 1)
+
+	go func() {
+
+		conn, err := socket.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+
+		buf, _ := io.ReadAll(conn)
+		conn.Write([]byte("done"))
+		conn.Close()
+
+		received <- buf
+	}()
+
+	conn, err := utp.DialTimeout(socket.Addr().String(), 3*time.Second)
+	assert.Nil(t, err)
+
+	var _ net.Conn = conn
+
+	n, err := conn.Write(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n)
+
+	// Closing our side sends a FIN, which ends the remote ReadAll
+	conn.Close()
+
+	assert.True(t, bytes.Equal(data, <-received))
+}
+
+func TestHalfClosedReply(t *testing.T) {
+
+	socket, err := utp.Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer socket.Close()
+
+	go func() {
+
+		conn, err := socket.Accept()
+		if err != nil {
+			return
+		}
+
+		buf := make([]byte, 4)
+		io.ReadFull(conn, buf)
+
+		conn.Write(bytes.ToUpper(buf))
+		conn.Close()
+	}()
+
+	conn, err := utp.DialTimeout(socket.Addr().String(), 3*time.Second)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+
+	reply, err := io.ReadAll(conn)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "PING", string(reply))
+}
+
+func TestReadDeadline(t *testing.T) {
+
+	socket, err := utp.Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	defer socket.Close()
+
+	go socket.Accept()
+
+	conn, err := utp.DialTimeout(socket.Addr().String(), 3*time.Second)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+	_, err = conn.Read(make([]byte, 1))
+
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout())
+}
+
+func TestDialTimeout(t *testing.T) {
+
+	// Nothing listens on this port, so the SYN is never answered
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer pc.Close()
+
+	_, err = utp.DialTimeout(pc.LocalAddr().String(), 200*time.Millisecond)
+
+	assert.Equal(t, utp.ErrTimeout, err)
+}
@@ -0,0 +1,673 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxPayload keeps a packet inside a typical 1500 byte MTU after the IP, UDP and uTP headers
+const maxPayload = 1380
+
+// receiveWindow is the amount of unread data we are willing to buffer
+const receiveWindow = 1 << 20
+
+// maxReorder is how far ahead of the last in-order packet we still buffer data
+const maxReorder = 1024
+
+// LEDBAT parameters: the queuing delay we aim for and how fast the window reacts
+const targetDelay = 100000 // microseconds
+const gain = 1.0
+
+const maxWindow = 4 << 20
+
+const initialRTO = time.Second
+const minRTO = 500 * time.Millisecond
+const maxRTO = 30 * time.Second
+
+// maxTransmissions is how often a packet is sent before the connection is declared dead
+const maxTransmissions = 8
+
+const tick = 50 * time.Millisecond
+
+// closeLinger bounds how long a closed connection keeps retransmitting unacknowledged data
+const closeLinger = 10 * time.Second
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosing
+	stateClosed
+)
+
+var ErrReset = errors.New("utp: connection reset by peer")
+var ErrTimeout = errors.New("utp: connection timed out")
+
+type outPacket struct {
+	p             *packet
+	sentAt        time.Time
+	transmissions int
+}
+
+// Conn is a reliable, ordered uTP stream implementing net.Conn
+type Conn struct {
+	socket *Socket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	state connState
+	err   error
+
+	seqNr uint16 // Next sequence number we send
+	ackNr uint16 // Last sequence number received in order
+
+	outgoing   []*outPacket
+	inFlight   int
+	cwnd       float64
+	peerWindow int
+	dupAcks    int
+
+	srtt   time.Duration
+	rttVar time.Duration
+	rto    time.Duration
+
+	// Minimum one-way delay seen in the current and the previous minute
+	baseDelays  [2]uint32
+	baseRotated time.Time
+
+	// Our latest measurement of the peer's one-way delay, echoed back in every packet
+	replyMicro uint32
+
+	readBuf     []byte
+	reorder     map[uint16]*packet
+	finReceived bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	lingerUntil   time.Time
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *Conn {
+
+	c := &Conn{
+
+		socket:      s,
+		remote:      remote,
+		recvID:      recvID,
+		sendID:      sendID,
+		cwnd:        2 * maxPayload,
+		peerWindow:  maxPayload,
+		rto:         initialRTO,
+		baseRotated: time.Now(),
+		reorder:     make(map[uint16]*packet),
+		done:        make(chan struct{}),
+	}
+
+	c.cond = sync.NewCond(&c.lock)
+
+	go c.timerLoop()
+
+	return c
+}
+
+func (c *Conn) connect(timeout time.Duration) error {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	deadline := time.Now().Add(timeout)
+
+	c.state = stateSynSent
+	c.seqNr = 1
+	c.sendTracked(stSyn, nil)
+
+	for c.state == stateSynSent {
+
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+
+		c.cond.Wait()
+	}
+
+	return c.err
+}
+
+// accept answers the SYN that created this connection. Called with the socket lock held.
+func (c *Conn) accept(syn *packet) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var b [2]byte
+	rand.Read(b[:])
+
+	c.state = stateConnected
+	c.seqNr = binary.BigEndian.Uint16(b[:])
+	c.ackNr = syn.seqNr
+	c.peerWindow = int(syn.window)
+	c.replyMicro = timestampMicro() - syn.timestamp
+
+	c.sendState()
+}
+
+func (c *Conn) abort(err error) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.fail(err)
+}
+
+// fail moves the connection to its final state. Called with the lock held.
+func (c *Conn) fail(err error) {
+
+	if c.state == stateClosed {
+		return
+	}
+
+	c.state = stateClosed
+
+	if c.err == nil {
+		c.err = err
+	}
+
+	c.closeOnce.Do(func() { close(c.done) })
+	c.cond.Broadcast()
+
+	// The socket lock may be held by our caller, so leave the map asynchronously
+	go c.socket.remove(c)
+}
+
+func (c *Conn) window() uint32 {
+
+	if len(c.readBuf) >= receiveWindow {
+		return 0
+	}
+
+	return uint32(receiveWindow - len(c.readBuf))
+}
+
+func (c *Conn) header(kind uint8, seqNr uint16) *packet {
+
+	connID := c.sendID
+
+	// The SYN is the only packet carrying the receive id
+	if kind == stSyn {
+		connID = c.recvID
+	}
+
+	return &packet{kind: kind, connID: connID, seqNr: seqNr}
+}
+
+func (c *Conn) transmit(op *outPacket) {
+
+	op.p.timestamp = timestampMicro()
+	op.p.timestampDiff = c.replyMicro
+	op.p.window = c.window()
+	op.p.ackNr = c.ackNr
+
+	op.sentAt = time.Now()
+	op.transmissions++
+
+	c.socket.send(op.p, c.remote)
+}
+
+// sendTracked sends a packet that consumes a sequence number and must be acknowledged
+func (c *Conn) sendTracked(kind uint8, payload []byte) {
+
+	p := c.header(kind, c.seqNr)
+	p.payload = payload
+
+	c.seqNr++
+
+	op := &outPacket{p: p}
+
+	c.outgoing = append(c.outgoing, op)
+	c.inFlight += len(payload)
+
+	c.transmit(op)
+}
+
+func (c *Conn) sendState() {
+
+	p := c.header(stState, c.seqNr)
+
+	p.timestamp = timestampMicro()
+	p.timestampDiff = c.replyMicro
+	p.window = c.window()
+	p.ackNr = c.ackNr
+
+	c.socket.send(p, c.remote)
+}
+
+func (c *Conn) receive(p *packet) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	if p.timestamp != 0 {
+		c.replyMicro = timestampMicro() - p.timestamp
+	}
+
+	c.peerWindow = int(p.window)
+
+	switch p.kind {
+
+	case stReset:
+		c.fail(ErrReset)
+		return
+
+	case stSyn:
+		// Our answer got lost
+		c.sendState()
+		return
+	}
+
+	if c.state == stateSynSent {
+
+		if p.kind != stState {
+			return
+		}
+
+		c.state = stateConnected
+		c.ackNr = p.seqNr - 1
+	}
+
+	c.processAck(p)
+
+	if p.kind == stData || p.kind == stFin {
+		c.processData(p)
+	}
+
+	c.cond.Broadcast()
+}
+
+func (c *Conn) processAck(p *packet) {
+
+	acked := 0
+	removed := 0
+	now := time.Now()
+
+	for len(c.outgoing) > 0 && !seqLess(p.ackNr, c.outgoing[0].p.seqNr) {
+
+		op := c.outgoing[0]
+
+		// Karn's algorithm: only packets sent once give a usable round-trip sample
+		if op.transmissions == 1 {
+			c.updateRTT(now.Sub(op.sentAt))
+		}
+
+		acked += len(op.p.payload)
+		removed++
+
+		c.outgoing = c.outgoing[1:]
+	}
+
+	c.inFlight -= acked
+
+	if removed > 0 {
+
+		c.dupAcks = 0
+		c.updateWindow(p.timestampDiff, acked)
+
+		return
+	}
+
+	if p.kind == stState && len(c.outgoing) > 0 && p.ackNr == c.outgoing[0].p.seqNr-1 {
+
+		c.dupAcks++
+
+		// Three duplicate acks: the head packet is most likely lost
+		if c.dupAcks == 3 {
+
+			c.cwnd /= 2
+			if c.cwnd < maxPayload {
+				c.cwnd = maxPayload
+			}
+
+			c.transmit(c.outgoing[0])
+		}
+	}
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+
+	if c.srtt == 0 {
+
+		c.srtt = sample
+		c.rttVar = sample / 2
+
+	} else {
+
+		delta := c.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+
+		c.rttVar += (delta - c.rttVar) / 4
+		c.srtt += (sample - c.srtt) / 8
+	}
+
+	c.rto = c.srtt + 4*c.rttVar
+
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// updateWindow applies the LEDBAT controller: grow while the queuing delay is below the target,
+// shrink when we are the ones filling up the bottleneck's buffers.
+func (c *Conn) updateWindow(delay uint32, acked int) {
+
+	ourDelay := 0.0
+
+	if delay != 0 {
+
+		if time.Since(c.baseRotated) > time.Minute {
+
+			c.baseDelays[1] = c.baseDelays[0]
+			c.baseDelays[0] = delay
+			c.baseRotated = time.Now()
+
+		} else if c.baseDelays[0] == 0 || delay < c.baseDelays[0] {
+
+			c.baseDelays[0] = delay
+		}
+
+		base := c.baseDelays[0]
+
+		if c.baseDelays[1] != 0 && c.baseDelays[1] < base {
+			base = c.baseDelays[1]
+		}
+
+		ourDelay = float64(delay - base)
+	}
+
+	offTarget := (targetDelay - ourDelay) / targetDelay
+
+	c.cwnd += gain * offTarget * float64(acked) * maxPayload / c.cwnd
+
+	if c.cwnd < maxPayload {
+		c.cwnd = maxPayload
+	}
+
+	if c.cwnd > maxWindow {
+		c.cwnd = maxWindow
+	}
+}
+
+func (c *Conn) processData(p *packet) {
+
+	// Already delivered, the ack must have been lost
+	if !seqLess(c.ackNr, p.seqNr) {
+
+		c.sendState()
+		return
+	}
+
+	if p.seqNr-c.ackNr > maxReorder {
+		return
+	}
+
+	if _, ok := c.reorder[p.seqNr]; !ok {
+		c.reorder[p.seqNr] = p
+	}
+
+	for !c.finReceived {
+
+		next, ok := c.reorder[c.ackNr+1]
+
+		if !ok {
+			break
+		}
+
+		delete(c.reorder, c.ackNr+1)
+		c.ackNr++
+
+		if next.kind == stFin {
+			c.finReceived = true
+		} else {
+			c.readBuf = append(c.readBuf, next.payload...)
+		}
+	}
+
+	c.sendState()
+}
+
+func (c *Conn) timerLoop() {
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+
+		case <-c.done:
+			return
+
+		case <-ticker.C:
+			c.onTick()
+		}
+	}
+}
+
+func (c *Conn) onTick() {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+
+	if len(c.outgoing) > 0 && now.Sub(c.outgoing[0].sentAt) > c.rto {
+
+		op := c.outgoing[0]
+
+		if op.transmissions >= maxTransmissions {
+
+			c.fail(ErrTimeout)
+			return
+		}
+
+		// A timeout means heavy congestion: collapse the window and back off
+		c.cwnd = maxPayload
+
+		c.rto *= 2
+		if c.rto > maxRTO {
+			c.rto = maxRTO
+		}
+
+		c.transmit(op)
+	}
+
+	if c.state == stateClosing && (len(c.outgoing) == 0 || now.After(c.lingerUntil)) {
+
+		c.fail(net.ErrClosed)
+		return
+	}
+
+	// Wakes up readers and writers so they can check their deadlines
+	c.cond.Broadcast()
+}
+
+func deadlinePassed(deadline time.Time) bool {
+
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.readBuf) == 0 {
+
+		if c.finReceived {
+			return 0, io.EOF
+		}
+
+		if c.state == stateClosing {
+			return 0, net.ErrClosed
+		}
+
+		if c.state == stateClosed {
+			return 0, c.err
+		}
+
+		if deadlinePassed(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		c.cond.Wait()
+	}
+
+	wasFull := len(c.readBuf) > receiveWindow/2
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+
+	if len(c.readBuf) == 0 {
+		c.readBuf = nil
+	}
+
+	// Let a peer that was held back by our window know it can send again
+	if wasFull && len(c.readBuf) <= receiveWindow/2 {
+		c.sendState()
+	}
+
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	written := 0
+
+	for len(b) > 0 {
+
+		chunk := len(b)
+		if chunk > maxPayload {
+			chunk = maxPayload
+		}
+
+		for {
+
+			if c.state == stateClosing {
+				return written, net.ErrClosed
+			}
+
+			if c.state == stateClosed {
+				return written, c.err
+			}
+
+			if deadlinePassed(c.writeDeadline) {
+				return written, os.ErrDeadlineExceeded
+			}
+
+			window := int(c.cwnd)
+			if c.peerWindow < window {
+				window = c.peerWindow
+			}
+
+			if c.inFlight == 0 || c.inFlight+chunk <= window {
+				break
+			}
+
+			c.cond.Wait()
+		}
+
+		c.sendTracked(stData, append([]byte(nil), b[:chunk]...))
+
+		b = b[chunk:]
+		written += chunk
+	}
+
+	return written, nil
+}
+
+func (c *Conn) Close() error {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch c.state {
+
+	case stateConnected:
+		c.sendTracked(stFin, nil)
+
+		c.state = stateClosing
+		c.lingerUntil = time.Now().Add(closeLinger)
+
+		c.cond.Broadcast()
+
+	case stateSynSent:
+		c.fail(net.ErrClosed)
+	}
+
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readDeadline = t
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeDeadline = t
+	c.cond.Broadcast()
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+/*
+	uTP packet format, as specified in BEP 29:
+	https://www.bittorrent.org/beps/bep_0029.html
+*/
+
+const (
+	stData  uint8 = 0
+	stFin   uint8 = 1
+	stState uint8 = 2
+	stReset uint8 = 3
+	stSyn   uint8 = 4
+)
+
+const version = 1
+
+const headerSize = 20
+
+type packet struct {
+	kind          uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	window        uint32
+	seqNr         uint16
+	ackNr         uint16
+	payload       []byte
+}
+
+func (p *packet) serialize() []byte {
+
+	// Header:
+	// 1 byte - type (high nibble) and version (low nibble)
+	// 1 byte - extension (we never send any)
+	// 2 bytes - connection id
+	// 4 bytes - timestamp in microseconds
+	// 4 bytes - timestamp difference in microseconds
+	// 4 bytes - advertised receive window
+	// 2 bytes - sequence number
+	// 2 bytes - ack number
+
+	buf := make([]byte, headerSize+len(p.payload))
+
+	buf[0] = p.kind<<4 | version
+	buf[1] = 0
+
+	binary.BigEndian.PutUint16(buf[2:4], p.connID)
+	binary.BigEndian.PutUint32(buf[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], p.window)
+	binary.BigEndian.PutUint16(buf[16:18], p.seqNr)
+	binary.BigEndian.PutUint16(buf[18:20], p.ackNr)
+
+	copy(buf[headerSize:], p.payload)
+
+	return buf
+}
+
+func parsePacket(buf []byte) (*packet, error) {
+
+	if len(buf) < headerSize {
+		return nil, errors.New("utp: packet too short")
+	}
+
+	if buf[0]&0x0f != version {
+		return nil, errors.New("utp: unsupported version")
+	}
+
+	p := &packet{
+
+		kind:          buf[0] >> 4,
+		connID:        binary.BigEndian.Uint16(buf[2:4]),
+		timestamp:     binary.BigEndian.Uint32(buf[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(buf[8:12]),
+		window:        binary.BigEndian.Uint32(buf[12:16]),
+		seqNr:         binary.BigEndian.Uint16(buf[16:18]),
+		ackNr:         binary.BigEndian.Uint16(buf[18:20]),
+	}
+
+	if p.kind > stSyn {
+		return nil, errors.New("utp: unknown packet type")
+	}
+
+	// Skip the extension chain: each entry is (next type, length, data)
+	extension := buf[1]
+	rest := buf[headerSize:]
+
+	for extension != 0 {
+
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, errors.New("utp: truncated extension")
+		}
+
+		extension = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+
+	// The read buffer is reused, so the payload gets its own copy
+	p.payload = append([]byte(nil), rest...)
+
+	return p, nil
+}
+
+func timestampMicro() uint32 {
+
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+// seqLess compares sequence numbers, which wrap around at 65536
+func seqLess(a, b uint16) bool {
+
+	return int16(a-b) < 0
+}
@@ -0,0 +1,263 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Socket multiplexes any number of uTP connections over a single UDP socket
+type Socket struct {
+	pc net.PacketConn
+
+	lock  sync.Mutex
+	conns map[connKey]*Conn
+
+	// Incoming connections, nil when the socket does not accept any
+	backlog chan *Conn
+
+	// A socket created by Dial belongs to its only connection and dies with it
+	owned bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+var errClosed = errors.New("utp: socket closed")
+
+func newSocket(pc net.PacketConn, listening, owned bool) *Socket {
+
+	s := &Socket{
+
+		pc:    pc,
+		conns: make(map[connKey]*Conn),
+		owned: owned,
+		done:  make(chan struct{}),
+	}
+
+	if listening {
+		s.backlog = make(chan *Conn, 32)
+	}
+
+	go s.readLoop()
+
+	return s
+}
+
+// Listen opens a UDP socket that accepts incoming uTP connections and can dial outgoing ones
+func Listen(address string) (*Socket, error) {
+
+	pc, err := net.ListenPacket("udp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newSocket(pc, true, false), nil
+}
+
+// DialTimeout connects to address from a fresh ephemeral UDP port
+func DialTimeout(address string, timeout time.Duration) (*Conn, error) {
+
+	pc, err := net.ListenPacket("udp", ":0")
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSocket(pc, false, true)
+
+	c, err := s.DialTimeout(address, timeout)
+
+	if err != nil {
+		s.Close()
+	}
+
+	return c, err
+}
+
+func (s *Socket) Addr() net.Addr {
+
+	return s.pc.LocalAddr()
+}
+
+func (s *Socket) Accept() (net.Conn, error) {
+
+	if s.backlog == nil {
+		return nil, errors.New("utp: socket is not listening")
+	}
+
+	select {
+
+	case c := <-s.backlog:
+		return c, nil
+
+	case <-s.done:
+		return nil, errClosed
+	}
+}
+
+func (s *Socket) DialTimeout(address string, timeout time.Duration) (*Conn, error) {
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+
+	var id uint16
+
+	// The peer answers on our receive id; the send id is always one higher
+	for {
+
+		var b [2]byte
+		rand.Read(b[:])
+
+		id = binary.BigEndian.Uint16(b[:])
+
+		if _, taken := s.conns[connKey{addr.String(), id}]; !taken {
+			break
+		}
+	}
+
+	c := newConn(s, addr, id, id+1)
+	s.conns[connKey{addr.String(), id}] = c
+
+	s.lock.Unlock()
+
+	if err = c.connect(timeout); err != nil {
+
+		c.abort(err)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (s *Socket) Close() error {
+
+	var err error
+
+	s.closeOnce.Do(func() {
+
+		close(s.done)
+		err = s.pc.Close()
+
+		s.lock.Lock()
+		conns := s.conns
+		s.conns = make(map[connKey]*Conn)
+		s.lock.Unlock()
+
+		for _, c := range conns {
+			c.abort(errClosed)
+		}
+	})
+
+	return err
+}
+
+func (s *Socket) send(p *packet, addr net.Addr) error {
+
+	_, err := s.pc.WriteTo(p.serialize(), addr)
+
+	return err
+}
+
+func (s *Socket) remove(c *Conn) {
+
+	s.lock.Lock()
+
+	delete(s.conns, connKey{c.remote.String(), c.recvID})
+	empty := len(s.conns) == 0
+
+	s.lock.Unlock()
+
+	if !s.owned || !empty {
+		return
+	}
+
+	select {
+
+	case <-s.done:
+		// Already shutting down
+
+	default:
+		s.Close()
+	}
+}
+
+func (s *Socket) readLoop() {
+
+	buf := make([]byte, 65535)
+
+	for {
+
+		n, addr, err := s.pc.ReadFrom(buf)
+
+		if err != nil {
+
+			s.Close()
+			return
+		}
+
+		p, err := parsePacket(buf[:n])
+
+		if err != nil {
+			continue
+		}
+
+		s.lock.Lock()
+
+		key := connKey{addr.String(), p.connID}
+		c, ok := s.conns[key]
+
+		if !ok && p.kind == stSyn {
+
+			// A retransmitted SYN belongs to the connection it already created
+			key.id = p.connID + 1
+			c, ok = s.conns[key]
+
+			if !ok && s.backlog != nil {
+
+				c = newConn(s, addr, p.connID+1, p.connID)
+				s.conns[key] = c
+
+				c.accept(p)
+
+				s.lock.Unlock()
+
+				select {
+
+				case s.backlog <- c:
+
+				default:
+					// Nobody is accepting, refuse the connection
+					c.abort(errors.New("utp: backlog full"))
+				}
+
+				continue
+			}
+		}
+
+		s.lock.Unlock()
+
+		if ok {
+
+			c.receive(p)
+
+		} else if p.kind != stReset {
+
+			s.send(&packet{kind: stReset, connID: p.connID, timestamp: timestampMicro(), ackNr: p.seqNr}, addr)
+		}
+	}
+}